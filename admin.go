@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/pprofhandler"
+)
+
+var enablePprof = getEnvBool("ENABLE_PPROF")
+var adminPort = getEnv("ADMIN_PORT")
+
+// metricsKeys holds METRICS_KEY's digest, compared like PROXYKEY in
+// constant time.
+var metricsKeys = []proxyKey{{label: "metrics", digest: sha256.Sum256([]byte(metricsKey))}}
+
+func init() {
+	if enablePprof && metricsKey == "" {
+		configError("ENABLE_PPROF", errors.New("METRICS_KEY must be set to guard the pprof endpoints"))
+	}
+}
+
+// adminHandler serves the operational endpoints, which are never proxied.
+// It reports whether the request was for one of them.
+func adminHandler(ctx *fasthttp.RequestCtx) bool {
+	return probeHandler(ctx) || metricsHandler(ctx) || pprofHandler(ctx) || debugVarsHandler(ctx) || cacheAdminHandler(ctx) || drainHandler(ctx) || maintenanceHandler(ctx) || hostStatsHandler(ctx)
+}
+
+// startAdminServer serves the admin endpoints on ADMIN_PORT, leaving the
+// main listener to proxy every path.
+func startAdminServer() *fasthttp.Server {
+	server := &fasthttp.Server{
+		Handler: withLocalCompression(func(ctx *fasthttp.RequestCtx) {
+			ctx.SetUserValue("admin_listener", true)
+			if !adminHandler(ctx) {
+				setError(&ctx.Response, 404, "not_found", "Not found.")
+			}
+		}),
+		ErrorHandler: serverError,
+	}
+	go func() {
+		if err := server.ListenAndServe(bindAddr(adminPort)); err != nil {
+			log.Fatalf("Error in admin ListenAndServe: %s", err)
+		}
+	}()
+	return server
+}
+
+// adminAuthorized checks the METRICSKEY header that guards the admin
+// endpoints, writing a 403 on mismatch.
+func adminAuthorized(ctx *fasthttp.RequestCtx) bool {
+	if metricsKey != "" && matchKey(metricsKeys, ctx.Request.Header.Peek("METRICSKEY")) == "" {
+		setError(&ctx.Response, 403, "forbidden", "Missing or invalid METRICSKEY header.")
+		return false
+	}
+	return true
+}
+
+// adminWriteAuthorized guards the endpoints that change the proxy's state,
+// such as draining it or purging the cache. Without METRICS_KEY they exist
+// only on ADMIN_PORT; the public listener answers 404 for them.
+func adminWriteAuthorized(ctx *fasthttp.RequestCtx) bool {
+	if metricsKey == "" && ctx.UserValue("admin_listener") == nil {
+		setError(&ctx.Response, 404, "not_found", "Not found.")
+		return false
+	}
+	return adminAuthorized(ctx)
+}
+
+func pprofHandler(ctx *fasthttp.RequestCtx) bool {
+	if !enablePprof || !strings.HasPrefix(string(ctx.Path()), "/debug/pprof/") {
+		return false
+	}
+	if adminAuthorized(ctx) {
+		pprofhandler.PprofHandler(ctx)
+	}
+	return true
+}
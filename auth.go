@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+type proxyKey struct {
+	label  string
+	digest [sha256.Size]byte
+}
+
+var authFailureMessage = getEnvString("AUTH_FAILURE_MESSAGE", "Missing or invalid PROXYKEY header.")
+
+// loadProxyKeys returns the accepted PROXYKEY values, or nil when no key is
+// required. It reads KEYS (comma-separated) or KEYS_FILE (one per line),
+// falling back to the single KEY. Entries may be written label=key so logs
+// can attribute usage without recording the key itself; see splitKeyLabel.
+func loadProxyKeys() []proxyKey {
+	path := getEnv("KEYS_FILE")
+	list, hasList := lookupEnv("KEYS")
+	single, hasSingle := lookupEnv("KEY")
+
+	var entries []string
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			configError("KEYS_FILE", err)
+			return nil
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	} else if hasList {
+		entries = splitList(list)
+	} else if hasSingle {
+		return []proxyKey{{label: "default", digest: sha256.Sum256([]byte(single))}}
+	} else {
+		return nil
+	}
+
+	if len(entries) == 0 {
+		source := "KEYS"
+		if path != "" {
+			source = "KEYS_FILE"
+		}
+		configError(source, fmt.Errorf("no keys given; unset it to run without a key"))
+		return nil
+	}
+	keys := make([]proxyKey, 0, len(entries))
+	for i, entry := range entries {
+		label, value, ok := splitKeyLabel(entry)
+		if !ok {
+			label, value = "key"+strconv.Itoa(i+1), entry
+		}
+		keys = append(keys, proxyKey{label: label, digest: sha256.Sum256([]byte(value))})
+	}
+	return keys
+}
+
+var keyLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// splitKeyLabel splits a label=key entry. The label must be made of
+// letters, digits, _ and -, and the key must be more than = padding, so a
+// base64 key such as "dGhpcyBpcyBhIGtleQ==" is taken whole rather than
+// split inside its padding.
+func splitKeyLabel(entry string) (string, string, bool) {
+	label, value, ok := strings.Cut(entry, "=")
+	if !ok || !keyLabelPattern.MatchString(label) || strings.Trim(value, "=") == "" {
+		return "", "", false
+	}
+	return label, value, true
+}
+
+// authorize checks the PROXYKEY header against every accepted key without
+// stopping at the first match, and records the matching key's label. With
+// MTLS_OR_KEY a verified client certificate is accepted instead of a key.
+// Comparing SHA-256 digests keeps every comparison the same length, since
+// ConstantTimeCompare returns early on a length mismatch.
+func authorize(ctx *fasthttp.RequestCtx) bool {
+	cn, hasCert := clientCertCN(ctx)
+	if hasCert {
+		ctx.SetUserValue("client_cn", cn)
+	}
+	keys := conf().ProxyKeys
+	if keys == nil || hasCert && mtlsOrKey {
+		return true
+	}
+	label := matchKey(keys, ctx.Request.Header.Peek("PROXYKEY"))
+	if label == "" {
+		return false
+	}
+	ctx.SetUserValue("key_label", label)
+	return true
+}
+
+// matchKey returns the label of the key matching value, or "" for none.
+func matchKey(keys []proxyKey, value []byte) string {
+	got := sha256.Sum256(value)
+	label := ""
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(got[:], k.digest[:]) == 1 {
+			label = k.label
+		}
+	}
+	return label
+}
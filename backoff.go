@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+var backoffBaseMs = getEnvPositiveInt("BACKOFF_BASE_MS", 100)
+var backoffFactor = getEnvFloat("BACKOFF_FACTOR", 2)
+var backoffMaxMs = getEnvPositiveInt("BACKOFF_MAX_MS", 2000)
+
+// backoffPolicy is the base window and cap for one kind of failure.
+// ERR_BACKOFF_MS applies after a request that failed without a response,
+// STATUS_BACKOFF_MS after a retryable status; both default to
+// BACKOFF_BASE_MS and BACKOFF_MAX_MS.
+type backoffPolicy struct {
+	name   string
+	baseMs int
+	maxMs  int
+}
+
+var errBackoff = backoffPolicy{"err", getEnvPositiveInt("ERR_BACKOFF_MS", backoffBaseMs), getEnvPositiveInt("ERR_BACKOFF_MAX_MS", backoffMaxMs)}
+var statusBackoff = backoffPolicy{"status", getEnvPositiveInt("STATUS_BACKOFF_MS", backoffBaseMs), getEnvPositiveInt("STATUS_BACKOFF_MAX_MS", backoffMaxMs)}
+
+// backoff returns the delay before retrying after the given attempt: an
+// exponentially growing window, capped as p says, with full jitter applied.
+func backoff(p backoffPolicy, attempt int) time.Duration {
+	window := math.Min(float64(p.maxMs), float64(p.baseMs)*math.Pow(math.Max(backoffFactor, 1), float64(attempt-1)))
+	return time.Duration(rand.Float64() * window * float64(time.Millisecond))
+}
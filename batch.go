@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+var batchMaxRequests = getEnvPositiveInt("BATCH_MAX_REQUESTS", 20)
+var batchConcurrency = getEnvPositiveInt("BATCH_CONCURRENCY", 5)
+
+type batchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+type batchResult struct {
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	Encoding string            `json:"encoding,omitempty"`
+}
+
+// batchHandler serves POST /batch, running each sub-request in the JSON
+// array through requestHandler, so they get the same limits, retries and
+// host checks as a normal request, at most BATCH_CONCURRENCY at a time.
+// Sub-requests inherit the batch's headers, overridden by their own. It
+// reports whether the request was a batch; batches can't be nested.
+func batchHandler(ctx *fasthttp.RequestCtx) bool {
+	if !ctx.IsPost() || string(ctx.Path()) != "/batch" || ctx.UserValue("in_batch") != nil {
+		return false
+	}
+	if !authorize(ctx) {
+		setError(&ctx.Response, 407, "proxy_auth_required", authFailureMessage)
+		return true
+	}
+	var reqs []batchRequest
+	if err := json.Unmarshal(ctx.PostBody(), &reqs); err != nil {
+		setError(&ctx.Response, 400, "invalid_batch", "Body must be a JSON array of requests.")
+		return true
+	}
+	if len(reqs) > batchMaxRequests {
+		setError(&ctx.Response, 400, "batch_too_large", "At most "+strconv.Itoa(batchMaxRequests)+" requests per batch.")
+		return true
+	}
+
+	results := make([]batchResult, len(reqs))
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, r := range reqs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			results[i] = runBatchRequest(ctx, r)
+		}()
+	}
+	wg.Wait()
+
+	rlog(ctx, map[string]any{"at": "batch", "level": "debug", "requests": len(reqs)})
+	b, _ := json.Marshal(results)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
+
+func runBatchRequest(parent *fasthttp.RequestCtx, r batchRequest) batchResult {
+	var req fasthttp.Request
+	parent.Request.Header.CopyTo(&req.Header)
+	req.Header.Del("Content-Length")
+	method := r.Method
+	if method == "" {
+		method = fasthttp.MethodGet
+	}
+	req.Header.SetMethod(method)
+	req.SetRequestURI(r.Path)
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBodyString(r.Body)
+
+	var sub fasthttp.RequestCtx
+	sub.Init(&req, parent.RemoteAddr(), nil)
+	sub.SetUserValue("in_batch", true)
+	requestHandler(&sub)
+
+	res := batchResult{Status: sub.Response.StatusCode(), Headers: map[string]string{}}
+	sub.Response.Header.VisitAll(func(k, v []byte) {
+		res.Headers[string(k)] = string(v)
+	})
+	body := sub.Response.Body()
+	if utf8.Valid(body) {
+		res.Body = string(body)
+	} else {
+		res.Body, res.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+type blockedPath struct {
+	pattern string
+	match   *regexp.Regexp
+}
+
+var blockedPaths = getEnvBlockedPaths("BLOCKED_PATHS")
+
+// getEnvBlockedPaths compiles comma-separated patterns matched against the
+// whole upstream host/path, without the query string: globs where * stands
+// for any run of characters, as in "auth.roblox.com/v1/*", or regular
+// expressions after a ~, as in "~^[^/]+/v1/users/\d+/password".
+func getEnvBlockedPaths(key string) []blockedPath {
+	var paths []blockedPath
+	for _, pattern := range getEnvList(key, "") {
+		expr, isRegexp := strings.CutPrefix(pattern, "~")
+		if !isRegexp {
+			expr = "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			configError(key, fmt.Errorf("pattern %q: %w", pattern, err))
+			continue
+		}
+		paths = append(paths, blockedPath{pattern: pattern, match: re})
+	}
+	return paths
+}
+
+// pathBlocked returns a 403 when host and the path of req, the upstream
+// request as it will be sent, match one of the BLOCKED_PATHS patterns, and
+// nil otherwise. fasthttp decodes the path and collapses dot segments and
+// repeated slashes, so matching that rather than the client's URI leaves
+// no way to spell a blocked path that still reaches it.
+func pathBlocked(ctx *fasthttp.RequestCtx, req *fasthttp.Request, host string) *fasthttp.Response {
+	path := string(req.URI().Path())
+	pattern := blockedPathPattern(host, path)
+	if pattern == "" {
+		return nil
+	}
+	rlog(ctx, map[string]any{"at": "path_blocked", "level": "warn", "target": strings.ToLower(host) + path, "pattern": pattern, "remote": clientIP(ctx).String()})
+	return errorResponse(403, "path_blocked", "This path is blocked by the proxy.")
+}
+
+// blockedPathPattern returns the BLOCKED_PATHS pattern matching host and
+// path, a normalized upstream path as returned by upstreamPath, or "" if
+// none does.
+func blockedPathPattern(host string, path string) string {
+	if len(blockedPaths) == 0 {
+		return ""
+	}
+	target := strings.ToLower(host) + path
+	for _, b := range blockedPaths {
+		if b.match.MatchString(target) {
+			return b.pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var cbFailureThreshold = getEnvInt("CB_FAILURE_THRESHOLD", 0)
+var cbResetSec = getEnvPositiveInt("CB_RESET_SEC", 30)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+var breakersMu sync.Mutex
+var breakers = map[string]*breaker{}
+
+// breakerAllow reports whether a request to host may be attempted. Once the
+// cooldown of an open breaker has elapsed, exactly one caller is let through
+// as the half-open probe.
+func breakerAllow(host string) bool {
+	if cbFailureThreshold <= 0 {
+		return true
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < time.Duration(cbResetSec)*time.Second {
+			return false
+		}
+		setBreakerState(host, b, breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// breakerRelease hands back a half-open probe that never reached host, so
+// the next caller probes instead. The cooldown has already run out.
+func breakerRelease(host string) {
+	if cbFailureThreshold <= 0 {
+		return
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[host]; ok && b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// breakerRecord feeds the outcome of an attempt to host into its breaker.
+func breakerRecord(host string, failed bool) {
+	if cbFailureThreshold <= 0 {
+		return
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		if !failed {
+			return
+		}
+		b = &breaker{state: breakerClosed}
+		breakers[host] = b
+	}
+
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			setBreakerState(host, b, breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= cbFailureThreshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			setBreakerState(host, b, breakerOpen)
+		}
+	}
+}
+
+func setBreakerState(host string, b *breaker, state string) {
+	level := "info"
+	if state == breakerOpen {
+		level = "warn"
+	}
+	jlog(map[string]any{"at": "breaker_" + state, "level": level, "host": host, "from": b.state, "failures": b.failures})
+	b.state = state
+}
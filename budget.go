@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The retry budget caps retries across all requests, so an outage doesn't
+// multiply the load on the upstream by RETRIES. Each retry spends a token;
+// tokens come in at RETRY_BUDGET_RATE a second plus RETRY_BUDGET_RATIO per
+// request received, up to RETRY_BUDGET_BURST. With neither rate nor ratio
+// set there is no budget.
+var retryBudgetRate = getEnvFloat("RETRY_BUDGET_RATE", 0)
+var retryBudgetRatio = getEnvFloat("RETRY_BUDGET_RATIO", 0)
+var retryBudgetBurst = getEnvPositiveInt("RETRY_BUDGET_BURST", int(math.Max(10, math.Ceil(retryBudgetRate))))
+
+var retryBudgetMu sync.Mutex
+var retryBudget = tokenBucket{tokens: float64(retryBudgetBurst), last: time.Now()}
+
+func init() {
+	if retryBudgetRate < 0 {
+		configError("RETRY_BUDGET_RATE", fmt.Errorf("must not be negative, got %v", retryBudgetRate))
+	}
+	if retryBudgetRatio < 0 {
+		configError("RETRY_BUDGET_RATIO", fmt.Errorf("must not be negative, got %v", retryBudgetRatio))
+	}
+}
+
+func retryBudgetEnabled() bool {
+	return retryBudgetRate > 0 || retryBudgetRatio > 0
+}
+
+// retryBudgetDeposit credits the budget for a new request.
+func retryBudgetDeposit() {
+	if retryBudgetRatio <= 0 {
+		return
+	}
+	retryBudgetMu.Lock()
+	retryBudget.refill(time.Now(), retryBudgetRate, retryBudgetBurst)
+	retryBudget.tokens = math.Min(float64(retryBudgetBurst), retryBudget.tokens+retryBudgetRatio)
+	retryBudgetMu.Unlock()
+}
+
+// retryBudgetAllow spends a token on a retry, reporting false, and logging
+// it, when the budget is exhausted.
+func retryBudgetAllow(ctx *fasthttp.RequestCtx, reason string, attempt int) bool {
+	if !retryBudgetEnabled() {
+		return true
+	}
+	retryBudgetMu.Lock()
+	ok, _ := retryBudget.take(time.Now(), retryBudgetRate, retryBudgetBurst)
+	retryBudgetMu.Unlock()
+	if !ok {
+		rlog(ctx, map[string]any{"at": "retry_budget_exhausted", "level": "warn", "reason": reason, "attempt": attempt, "uri": string(ctx.RequestURI())})
+	}
+	return ok
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var cacheTTLSec = getEnvInt("CACHE_TTL_SEC", 0)
+var cacheMaxEntries = getEnvPositiveInt("CACHE_MAX_ENTRIES", 1000)
+var cacheTTLRules = getEnvCacheRules("CACHE_TTL_RULES")
+var cacheSWRSec = getEnvNonNegativeInt("CACHE_SWR_SEC", 0)
+var cacheStaleMaxSec = getEnvNonNegativeInt("CACHE_STALE_MAX_SEC", 300)
+
+// SERVE_STALE_ON_ERROR answers a GET whose upstream request failed from an
+// expired entry up to CACHE_STALE_MAX_SEC past expiry, if there is one.
+var serveStaleOnError = getEnvBool("SERVE_STALE_ON_ERROR")
+
+type cacheRule struct {
+	match  *regexp.Regexp
+	ttlSec int
+}
+
+// getEnvCacheRules parses comma-separated pattern=seconds rules. A pattern
+// with * is matched against the whole host/path, * standing for any run of
+// characters; one without is matched anywhere in it.
+func getEnvCacheRules(key string) []cacheRule {
+	var rules []cacheRule
+	for _, item := range getEnvList(key, "") {
+		pattern, ttl, ok := strings.Cut(item, "=")
+		pattern = strings.TrimSpace(pattern)
+		sec, err := strconv.Atoi(strings.TrimSpace(ttl))
+		if !ok || pattern == "" || err != nil || sec < 0 {
+			configError(key, fmt.Errorf("invalid rule %q, want pattern=seconds", item))
+			continue
+		}
+		expr := regexp.QuoteMeta(pattern)
+		if strings.Contains(pattern, "*") {
+			expr = "^" + strings.ReplaceAll(expr, `\*`, ".*") + "$"
+		}
+		rules = append(rules, cacheRule{match: regexp.MustCompile(expr), ttlSec: sec})
+	}
+	return rules
+}
+
+// cacheTTL returns how long to keep the response for key: the first
+// matching CACHE_TTL_RULES entry's TTL, or CACHE_TTL_SEC. Rules see the
+// path as it is sent upstream, followed by the query string.
+func cacheTTL(key string) time.Duration {
+	host, path, _ := strings.Cut(strings.TrimPrefix(key, "https://"), "/")
+	target := host + upstreamPath(path)
+	if _, query, ok := strings.Cut(path, "?"); ok {
+		target += "?" + query
+	}
+	for _, r := range cacheTTLRules {
+		if r.match.MatchString(target) {
+			return time.Duration(r.ttlSec) * time.Second
+		}
+	}
+	return time.Duration(cacheTTLSec) * time.Second
+}
+
+type cacheEntry struct {
+	key           string
+	resp          *fasthttp.Response
+	stored        time.Time
+	expires       time.Time
+	refreshFailed bool
+}
+
+var cacheMu sync.Mutex
+var cacheLRU = list.New()
+var cacheIndex = map[string]*list.Element{}
+var cacheRefreshing = map[string]bool{}
+
+var cacheStats struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// cacheable reports whether the client request may be answered from the
+// response cache. Requests carrying credentials are never cached so one
+// client's private response can't be served to another. HEAD is answered
+// from cached GETs but, having no body, never stored itself.
+func cacheable(ctx *fasthttp.RequestCtx) bool {
+	return cacheEnabled() &&
+		(ctx.IsGet() || ctx.IsHead()) &&
+		len(ctx.Request.Header.Peek("Cookie")) == 0 &&
+		len(ctx.Request.Header.Peek("Authorization")) == 0
+}
+
+func cacheEnabled() bool {
+	return cacheTTLSec > 0 || len(cacheTTLRules) > 0
+}
+
+// cacheRequestMode reads the client's cache directives: "bypass" for
+// Cache-Control: no-cache or X-Proxy-Cache-Bypass: true, which skips the
+// lookup but still stores the fresh response, and "only-if-cached", which
+// never goes upstream. only-if-cached wins if both are sent. Neither
+// changes how long a stored entry lives.
+func cacheRequestMode(ctx *fasthttp.RequestCtx) string {
+	cc := strings.ToLower(string(ctx.Request.Header.Peek("Cache-Control")))
+	switch {
+	case strings.Contains(cc, "only-if-cached"):
+		return "only-if-cached"
+	case strings.Contains(cc, "no-cache"), string(ctx.Request.Header.Peek("X-Proxy-Cache-Bypass")) == "true":
+		return "bypass"
+	}
+	return ""
+}
+
+// cacheGet returns a copy of the cached response for key, or nil on a miss,
+// and whether it is past its TTL but still within CACHE_SWR_SEC. The caller
+// must release the returned response.
+func cacheGet(key string) (*fasthttp.Response, bool) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	el, ok := cacheIndex[key]
+	if !ok {
+		cacheStats.misses.Add(1)
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	stale := false
+	if past := time.Since(entry.expires); past > 0 {
+		staleMax := past < time.Duration(cacheStaleMaxSec)*time.Second
+		if !(past < time.Duration(cacheSWRSec)*time.Second || entry.refreshFailed && staleMax) {
+			if serveStaleOnError && staleMax {
+				// Kept in case the upstream fails and it's needed after all.
+				cacheStats.misses.Add(1)
+				return nil, false
+			}
+			cacheLRU.Remove(el)
+			delete(cacheIndex, key)
+			cacheStats.evictions.Add(1)
+			cacheStats.misses.Add(1)
+			return nil, false
+		}
+		stale = true
+	}
+	cacheStats.hits.Add(1)
+	cacheLRU.MoveToFront(el)
+	r := fasthttp.AcquireResponse()
+	entry.resp.CopyTo(r)
+	return r, stale
+}
+
+// staleOnError returns, with SERVE_STALE_ON_ERROR, a copy of the entry for
+// key to serve instead of resp, a 5xx, which it releases. The copy carries
+// X-Cache: STALE-ERROR and an Age from when it was stored.
+func staleOnError(ctx *fasthttp.RequestCtx, key string, resp *fasthttp.Response) (*fasthttp.Response, bool) {
+	if !serveStaleOnError || resp.StatusCode() < 500 {
+		return resp, false
+	}
+	var r *fasthttp.Response
+	var stored time.Time
+	cacheMu.Lock()
+	if el, ok := cacheIndex[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if time.Since(entry.expires) < time.Duration(cacheStaleMaxSec)*time.Second {
+			r = fasthttp.AcquireResponse()
+			entry.resp.CopyTo(r)
+			stored = entry.stored
+		}
+	}
+	cacheMu.Unlock()
+	if r == nil {
+		return resp, false
+	}
+	age := int(time.Since(stored).Seconds())
+	rlog(ctx, map[string]any{"at": "stale_on_error", "level": "warn", "key": key, "status": resp.StatusCode(), "age_sec": age})
+	fasthttp.ReleaseResponse(resp)
+	r.Header.Set("Age", strconv.Itoa(age))
+	return r, true
+}
+
+// revalidate refreshes a stale entry in the background, at most once per key
+// at a time, from a detached copy of the request since ctx is recycled as
+// soon as the handler returns. A stale HEAD hit refreshes with a GET, since
+// the entry is shared with GETs and a HEAD response has no body. A failed
+// refresh lets the stale entry be served for up to CACHE_STALE_MAX_SEC past
+// expiry.
+func revalidate(ctx *fasthttp.RequestCtx, key string) {
+	cacheMu.Lock()
+	if cacheRefreshing[key] {
+		cacheMu.Unlock()
+		return
+	}
+	cacheRefreshing[key] = true
+	cacheMu.Unlock()
+
+	bg := &fasthttp.RequestCtx{}
+	bg.Init(&ctx.Request, ctx.RemoteAddr(), nil)
+	bg.Request.Header.SetMethod(fasthttp.MethodGet)
+	bg.SetUserValue("request_id", ctx.UserValue("request_id"))
+	go func() {
+		resp := makeRequest(bg, newAttemptState(bg))
+		cacheStore(key, resp)
+		ok := resp.StatusCode() == 200
+		fasthttp.ReleaseResponse(resp)
+
+		cacheMu.Lock()
+		delete(cacheRefreshing, key)
+		if el, found := cacheIndex[key]; found && !ok {
+			el.Value.(*cacheEntry).refreshFailed = true
+		}
+		cacheMu.Unlock()
+		rlog(bg, map[string]any{"at": "cache_revalidate", "level": "debug", "key": key, "ok": ok})
+	}()
+}
+
+// cacheStore saves a copy of resp under key if the upstream allows it, and
+// reports whether it did.
+func cacheStore(key string, resp *fasthttp.Response) bool {
+	ttl := cacheTTL(key)
+	if ttl <= 0 || resp.StatusCode() != 200 || bytes.Contains(resp.Header.Peek("Cache-Control"), []byte("no-store")) {
+		return false
+	}
+	resp.Body() // buffers a streamed body so it can be copied
+	stored := &fasthttp.Response{}
+	resp.CopyTo(stored)
+	now := time.Now()
+	entry := &cacheEntry{key: key, resp: stored, stored: now, expires: now.Add(ttl)}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if el, ok := cacheIndex[key]; ok {
+		el.Value = entry
+		cacheLRU.MoveToFront(el)
+		return true
+	}
+	cacheIndex[key] = cacheLRU.PushFront(entry)
+	for cacheLRU.Len() > cacheMaxEntries {
+		oldest := cacheLRU.Back()
+		cacheLRU.Remove(oldest)
+		delete(cacheIndex, oldest.Value.(*cacheEntry).key)
+		cacheStats.evictions.Add(1)
+	}
+	return true
+}
+
+// cachePurge drops every entry whose key starts with prefix and returns
+// how many were removed.
+func cachePurge(prefix string) int {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	n := 0
+	for key, el := range cacheIndex {
+		if strings.HasPrefix(key, prefix) {
+			cacheLRU.Remove(el)
+			delete(cacheIndex, key)
+			n++
+		}
+	}
+	return n
+}
+
+// cacheAdminHandler serves GET /admin/cache/stats, POST /admin/cache/purge,
+// optionally limited to keys starting with the prefix query parameter, and
+// POST /admin/cache/warm. It reports whether the request was for any of
+// them.
+func cacheAdminHandler(ctx *fasthttp.RequestCtx) bool {
+	path := string(ctx.Path())
+	if path != "/admin/cache/stats" && path != "/admin/cache/purge" && path != "/admin/cache/warm" {
+		return false
+	}
+	authorized := adminAuthorized
+	if path != "/admin/cache/stats" {
+		authorized = adminWriteAuthorized
+	}
+	if !authorized(ctx) {
+		return true
+	}
+	var body map[string]any
+	switch {
+	case path == "/admin/cache/stats" && ctx.IsGet():
+		cacheMu.Lock()
+		size := cacheLRU.Len()
+		cacheMu.Unlock()
+		body = map[string]any{
+			"hits":        cacheStats.hits.Load(),
+			"misses":      cacheStats.misses.Load(),
+			"evictions":   cacheStats.evictions.Load(),
+			"size":        size,
+			"max_entries": cacheMaxEntries,
+		}
+	case path == "/admin/cache/purge" && ctx.IsPost():
+		prefix := string(ctx.QueryArgs().Peek("prefix"))
+		n := cachePurge(prefix)
+		jlog(map[string]any{"at": "cache_purged", "prefix": prefix, "removed": n})
+		body = map[string]any{"removed": n}
+	case path == "/admin/cache/warm" && ctx.IsPost():
+		if !cacheEnabled() {
+			setError(&ctx.Response, 409, "cache_disabled", "Caching is not enabled.")
+			return true
+		}
+		var urls []string
+		if err := json.Unmarshal(ctx.PostBody(), &urls); err != nil {
+			setError(&ctx.Response, 400, "invalid_urls", "Body must be a JSON array of URLs.")
+			return true
+		}
+		if len(urls) > cacheWarmMaxURLs {
+			setError(&ctx.Response, 400, "too_many_urls", "At most "+strconv.Itoa(cacheWarmMaxURLs)+" URLs per request.")
+			return true
+		}
+		body = cacheWarm(ctx, urls)
+	default:
+		setError(&ctx.Response, 405, "method_not_allowed", "Method not allowed.")
+		return true
+	}
+	b, _ := json.Marshal(body)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
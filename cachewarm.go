@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var cacheWarmMaxURLs = getEnvPositiveInt("CACHE_WARM_MAX_URLS", 100)
+
+type warmResult struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// cacheWarm fetches each https://host/path URL in turn through makeRequest
+// and stores it as a normal GET would be. Each fetch is subject to
+// ALLOWED_HOSTS, BLOCKED_PATHS, MAX_CONCURRENT and the upstream rate limit.
+func cacheWarm(ctx *fasthttp.RequestCtx, urls []string) map[string]any {
+	results := make([]warmResult, len(urls))
+	warmed := 0
+	for i, raw := range urls {
+		results[i] = warmURL(ctx, raw)
+		if results[i].Error == "" {
+			warmed++
+		}
+	}
+	jlog(map[string]any{"at": "cache_warmed", "urls": len(urls), "warmed": warmed})
+	return map[string]any{"warmed": warmed, "failed": len(urls) - warmed, "results": results}
+}
+
+func warmURL(parent *fasthttp.RequestCtx, raw string) warmResult {
+	res := warmResult{URL: raw}
+	host, path, ok := strings.Cut(strings.TrimPrefix(raw, "https://"), "/")
+	if !ok || host == "" || !strings.HasPrefix(raw, "https://") {
+		res.Error = "invalid_url"
+		return res
+	}
+
+	var req fasthttp.Request
+	req.Header.SetMethod(fasthttp.MethodGet)
+	if hostFromHeader {
+		req.SetRequestURI("/" + path)
+		req.Header.Set(targetHostHeader, host)
+	} else {
+		req.SetRequestURI("/" + host + "/" + path)
+	}
+	var sub fasthttp.RequestCtx
+	sub.Init(&req, parent.RemoteAddr(), nil)
+	sub.SetUserValue("request_id", parent.UserValue("request_id"))
+
+	host, path, ok = target(&sub)
+	switch {
+	case !ok:
+		res.Error = "invalid_url"
+		return res
+	case !hostAllowed(host):
+		res.Error = "host_not_allowed"
+		return res
+	case blockedPathPattern(host, upstreamPath(path)) != "":
+		res.Error = "path_blocked"
+		return res
+	case !acquireSlot(&sub):
+		res.Error = "overloaded"
+		return res
+	}
+	defer releaseSlot()
+
+	resp := makeRequest(&sub, newAttemptState(&sub))
+	defer fasthttp.ReleaseResponse(resp)
+	res.Status = resp.StatusCode()
+	if res.Status != 200 {
+		res.Error = "upstream_status"
+		return res
+	}
+	if !cacheStore("https://"+host+"/"+path, resp) {
+		res.Error = "not_cacheable"
+	}
+	return res
+}
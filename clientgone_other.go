@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "github.com/valyala/fasthttp"
+
+func clientGone(ctx *fasthttp.RequestCtx) bool {
+	return false
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/valyala/fasthttp"
+)
+
+// clientGone reports whether the client has closed its connection. It peeks
+// at the socket without consuming anything, so pipelined requests are left
+// intact for fasthttp to read.
+func clientGone(ctx *fasthttp.RequestCtx) bool {
+	// Unwrap TLS and PROXY protocol layers, in whatever order, to the
+	// socket.
+	conn := ctx.Conn()
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	gone := false
+	raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		gone = (n == 0 && err == nil) || err == syscall.ECONNRESET
+		return true
+	})
+	return gone
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientGoneThroughProxyProtocol(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := proxyProtoListener{tcp}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var ctx fasthttp.RequestCtx
+	ctx.Init2(conn, nil, false)
+
+	if clientGone(&ctx) {
+		t.Fatal("client gone while still connected")
+	}
+	client.Close()
+	deadline := time.Now().Add(time.Second)
+	for !clientGone(&ctx) {
+		if time.Now().After(deadline) {
+			t.Fatal("client close not seen through the PROXY protocol wrapper")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
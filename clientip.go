@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/valyala/fasthttp"
+)
+
+var trustedProxies = getEnvCIDRs("TRUSTED_PROXIES")
+
+// clientIP returns the address to attribute the request to. When the peer
+// is one of TRUSTED_PROXIES, that's the rightmost X-Forwarded-For entry not
+// itself a trusted proxy; otherwise the header is ignored and it's the peer.
+func clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	peer := ctx.RemoteIP()
+	if !ipInNets(peer, trustedProxies) {
+		return peer
+	}
+	entries := bytes.Split(ctx.Request.Header.Peek("X-Forwarded-For"), []byte(","))
+	ip := peer
+	for i := len(entries) - 1; i >= 0; i-- {
+		next := net.ParseIP(string(bytes.TrimSpace(entries[i])))
+		if next == nil {
+			break
+		}
+		ip = next
+		if !ipInNets(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// priorForwardedFor returns the incoming X-Forwarded-For chain to extend.
+// With TRUSTED_PROXIES set, a chain sent by anyone else is dropped.
+func priorForwardedFor(ctx *fasthttp.RequestCtx) []byte {
+	if len(trustedProxies) > 0 && !ipInNets(ctx.RemoteIP(), trustedProxies) {
+		return nil
+	}
+	return ctx.Request.Header.Peek("X-Forwarded-For")
+}
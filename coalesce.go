@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+var coalesceGets = getEnvBool("COALESCE_GETS")
+
+type flight struct {
+	done    chan struct{}
+	resp    *fasthttp.Response
+	waiters int
+}
+
+var flightMu sync.Mutex
+var flights = map[string]*flight{}
+
+// coalescedRequest forwards the request, except that with COALESCE_GETS
+// concurrent GETs or HEADs for the same upstream URI share one upstream
+// call and each get a copy of its response, errors included. Requests
+// carrying credentials always go upstream on their own.
+func coalescedRequest(ctx *fasthttp.RequestCtx, upHost string, upPath string) *fasthttp.Response {
+	if !coalesceGets || !(ctx.IsGet() || ctx.IsHead()) ||
+		len(ctx.Request.Header.Peek("Cookie")) > 0 || len(ctx.Request.Header.Peek("Authorization")) > 0 {
+		return makeRequest(ctx, newAttemptState(ctx))
+	}
+	key := string(ctx.Method()) + " " + upHost + "/" + upPath
+
+	flightMu.Lock()
+	f, ok := flights[key]
+	if ok {
+		f.waiters++
+	} else {
+		f = &flight{done: make(chan struct{})}
+		flights[key] = f
+	}
+	flightMu.Unlock()
+
+	if ok {
+		<-f.done
+		r := fasthttp.AcquireResponse()
+		f.resp.CopyTo(r)
+		return r
+	}
+
+	resp := makeRequest(ctx, newAttemptState(ctx))
+	flightMu.Lock()
+	delete(flights, key)
+	waiters := f.waiters
+	flightMu.Unlock()
+	if waiters > 0 {
+		resp.Body() // buffers a streamed body so it can be copied
+		f.resp = &fasthttp.Response{}
+		resp.CopyTo(f.resp)
+		rlog(ctx, map[string]any{"at": "coalesced", "level": "debug", "waiters": waiters, "status": resp.StatusCode()})
+	}
+	close(f.done)
+	return resp
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var maxConcurrent = getEnvInt("MAX_CONCURRENT", 0)
+
+var concurrencySlots chan struct{}
+
+func startConcurrencyLimiter() {
+	concurrencySlots = make(chan struct{}, maxConcurrent)
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			jlog(map[string]any{"at": "concurrency", "in_flight": len(concurrencySlots), "max": maxConcurrent})
+		}
+	}()
+}
+
+// acquireSlot claims one of the MAX_CONCURRENT request slots without
+// waiting. When none is free it writes a 503 and reports false; otherwise
+// the caller must call releaseSlot when done.
+func acquireSlot(ctx *fasthttp.RequestCtx) bool {
+	if concurrencySlots == nil {
+		return true
+	}
+	select {
+	case concurrencySlots <- struct{}{}:
+		return true
+	default:
+		setError(&ctx.Response, 503, "overloaded", "Too many concurrent requests.")
+		ctx.Response.Header.Set("Retry-After", "1")
+		return false
+	}
+}
+
+func releaseSlot() {
+	if concurrencySlots != nil {
+		<-concurrencySlots
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var configFile = os.Getenv("CONFIG_FILE")
+
+// fileSettings holds the values from CONFIG_FILE, keyed by the same names
+// as the environment variables they stand in for.
+var fileSettings = loadInitialConfigFile()
+
+// knownSettings records every setting name the proxy has looked up, so
+// typos in CONFIG_FILE can be reported. Loaders must therefore look up all
+// of their keys, even ones they end up not using.
+var knownSettings = map[string]bool{"CONFIG_FILE": true}
+
+var secretSettings = map[string]bool{
+	"KEY": true, "KEYS": true, "METRICS_KEY": true, "ROBLOX_COOKIE": true,
+	"EGRESS_PROXY": true, "OTEL_EXPORTER_OTLP_HEADERS": true,
+}
+
+// lookupEnv returns a setting from the environment, falling back to
+// CONFIG_FILE, so environment variables always win.
+func lookupEnv(key string) (string, bool) {
+	knownSettings[key] = true
+	if val, ok := os.LookupEnv(key); ok {
+		return val, true
+	}
+	val, ok := fileSettings[key]
+	return val, ok
+}
+
+func getEnv(key string) string {
+	val, _ := lookupEnv(key)
+	return val
+}
+
+func getEnvBool(key string) bool {
+	return getEnv(key) == "true"
+}
+
+func loadInitialConfigFile() map[string]string {
+	if configFile == "" {
+		return nil
+	}
+	settings, err := readConfigFile(configFile)
+	if err != nil {
+		configError("CONFIG_FILE", err)
+	}
+	return settings
+}
+
+// readConfigFile parses a JSON object of settings. Strings, numbers and
+// booleans are taken as-is; arrays become the comma-separated lists the
+// environment variables use.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, val := range raw {
+		s, err := settingString(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		settings[key] = s
+	}
+	return settings, nil
+}
+
+func settingString(val any) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := settingString(item)
+			if err != nil || strings.Contains(s, ",") {
+				return "", fmt.Errorf("list items must be scalars without commas")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", val)
+}
+
+// checkConfigFileKeys flags CONFIG_FILE settings that nothing looked up.
+func checkConfigFileKeys() {
+	for key := range fileSettings {
+		if !knownSettings[key] {
+			configError(key, fmt.Errorf("unknown setting in CONFIG_FILE"))
+		}
+	}
+}
+
+// redactedFileSettings returns the CONFIG_FILE values fit for logging. An
+// EGRESS_PROXY URL keeps everything but its password.
+func redactedFileSettings() map[string]string {
+	out := make(map[string]string, len(fileSettings))
+	for key, val := range fileSettings {
+		if u, err := url.Parse(val); key == "EGRESS_PROXY" && err == nil && u.Host != "" {
+			val = u.Redacted()
+		} else if secretSettings[key] {
+			val = "[redacted]"
+		}
+		out[key] = val
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var maxTotalConns = getEnvNonNegativeInt("MAX_TOTAL_CONNS", 0)
+var maxTotalConnsMode = getEnvString("MAX_TOTAL_CONNS_MODE", "block")
+
+var errConnLimit = errors.New("too many upstream connections")
+
+var upstreamConns atomic.Int64
+var connSlots chan struct{}
+
+func init() {
+	if maxTotalConnsMode != "block" && maxTotalConnsMode != "shed" {
+		configError("MAX_TOTAL_CONNS_MODE", fmt.Errorf("must be block or shed, got %q", maxTotalConnsMode))
+	}
+	if maxTotalConns > 0 {
+		connSlots = make(chan struct{}, maxTotalConns)
+	}
+}
+
+// countConns wraps dial so every open upstream connection is counted, and
+// with MAX_TOTAL_CONNS caps how many can be open at once across all hosts.
+// Over the cap, block mode waits up to DIAL_TIMEOUT for one to close and
+// shed mode fails straight away; either way the error is errConnLimit.
+func countConns(dial fasthttp.DialFunc) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		if connSlots != nil && !acquireConnSlot() {
+			return nil, errConnLimit
+		}
+		conn, err := dial(addr)
+		if err != nil {
+			releaseConnSlot()
+			return nil, err
+		}
+		upstreamConns.Add(1)
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+func acquireConnSlot() bool {
+	select {
+	case connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if maxTotalConnsMode == "shed" {
+		return false
+	}
+	t := time.NewTimer(time.Duration(dialTimeout) * time.Second)
+	defer t.Stop()
+	select {
+	case connSlots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func releaseConnSlot() {
+	if connSlots != nil {
+		<-connSlots
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		upstreamConns.Add(-1)
+		releaseConnSlot()
+	})
+	return c.Conn.Close()
+}
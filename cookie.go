@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var robloxCookie = loadRobloxCookie()
+var robloxCookieHosts = lowerList(getEnvList("ROBLOX_COOKIE_HOSTS", "roblox.com"))
+
+func loadRobloxCookie() string {
+	path := getEnv("ROBLOX_COOKIE_FILE")
+	cookie := getEnv("ROBLOX_COOKIE")
+	if path == "" {
+		return cookie
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		configError("ROBLOX_COOKIE_FILE", err)
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// applyRobloxCookie replaces any client-supplied .ROBLOSECURITY with the
+// configured one, but only for hosts in ROBLOX_COOKIE_HOSTS so the
+// credential is never sent anywhere else.
+func applyRobloxCookie(req *fasthttp.Request, host string) {
+	if robloxCookie == "" || !hostMatches(host, robloxCookieHosts) {
+		return
+	}
+	req.Header.DelCookie(".ROBLOSECURITY")
+	req.Header.SetCookie(".ROBLOSECURITY", robloxCookie)
+}
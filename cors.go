@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var corsAllowOrigins = getEnvList("CORS_ALLOW_ORIGIN", "")
+var corsAllowMethods = getEnvString("CORS_ALLOW_METHODS", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+var corsAllowHeaders = getEnvString("CORS_ALLOW_HEADERS", "Content-Type, PROXYKEY, X-CSRF-TOKEN, X-Request-ID")
+var corsMaxAgeSec = getEnvInt("CORS_MAX_AGE_SEC", 600)
+
+// corsPreflight answers an OPTIONS request locally instead of forwarding it,
+// when CORS_ALLOW_ORIGIN is set, and reports whether it did.
+func corsPreflight(ctx *fasthttp.RequestCtx) bool {
+	if len(corsAllowOrigins) == 0 || !ctx.IsOptions() {
+		return false
+	}
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", corsAllowMethods)
+	ctx.Response.Header.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	if corsMaxAgeSec > 0 {
+		ctx.Response.Header.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAgeSec))
+	}
+	ctx.SetStatusCode(204)
+	return true
+}
+
+// applyCORS sets Access-Control-Allow-Origin on the final response, proxied
+// or not, overriding whatever the upstream sent. With a list of origins only
+// a matching Origin is echoed back.
+func applyCORS(ctx *fasthttp.RequestCtx) {
+	if len(corsAllowOrigins) == 0 {
+		return
+	}
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	for _, allowed := range corsAllowOrigins {
+		if allowed == "*" {
+			ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+			return
+		}
+		if strings.EqualFold(allowed, origin) {
+			ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+			ctx.Response.Header.Add("Vary", "Origin")
+			return
+		}
+	}
+	ctx.Response.Header.Del("Access-Control-Allow-Origin")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var autoCSRF = getEnvBool("AUTO_CSRF")
+
+// csrfTokens caches the last X-CSRF-TOKEN issued by each upstream host to
+// each session. Roblox ties a token to the session cookie, so entries are
+// keyed by host and a digest of the forwarded Cookie header, and at most
+// csrfMaxEntries are kept, the least recently used going first.
+const csrfMaxEntries = 4096
+
+type csrfEntry struct {
+	key   string
+	token string
+}
+
+var csrfMu sync.Mutex
+var csrfLRU = list.New()
+var csrfTokens = map[string]*list.Element{}
+
+func csrfKey(req *fasthttp.Request, host string) string {
+	digest := sha256.Sum256(req.Header.Peek("Cookie"))
+	return host + "\x00" + string(digest[:])
+}
+
+func applyCSRFToken(req *fasthttp.Request, host string) {
+	if !autoCSRF || len(req.Header.Peek("X-CSRF-TOKEN")) > 0 {
+		return
+	}
+	csrfMu.Lock()
+	defer csrfMu.Unlock()
+	if el, ok := csrfTokens[csrfKey(req, host)]; ok {
+		csrfLRU.MoveToFront(el)
+		req.Header.Set("X-CSRF-TOKEN", el.Value.(*csrfEntry).token)
+	}
+}
+
+func storeCSRFToken(req *fasthttp.Request, host string, token string) {
+	key := csrfKey(req, host)
+	csrfMu.Lock()
+	defer csrfMu.Unlock()
+	if el, ok := csrfTokens[key]; ok {
+		el.Value.(*csrfEntry).token = token
+		csrfLRU.MoveToFront(el)
+		return
+	}
+	csrfTokens[key] = csrfLRU.PushFront(&csrfEntry{key: key, token: token})
+	if csrfLRU.Len() > csrfMaxEntries {
+		oldest := csrfLRU.Back()
+		csrfLRU.Remove(oldest)
+		delete(csrfTokens, oldest.Value.(*csrfEntry).key)
+	}
+}
+
+// doUpstream performs req and returns the response, which the caller must
+// release. A non-zero timeout bounds each request sent. With AUTO_CSRF, a
+// 403 carrying a fresh X-CSRF-TOKEN is replayed exactly once with that
+// token. Roblox rejects these before acting on the request, so the replay
+// is safe for any method.
+func doUpstream(ctx *fasthttp.RequestCtx, req *fasthttp.Request, host string, timeout time.Duration) (*fasthttp.Response, error) {
+	resp, err := upstreamDo(ctx, req, timeout)
+	if err != nil || !autoCSRF || resp.StatusCode() != 403 {
+		return resp, err
+	}
+	token := resp.Header.Peek("X-CSRF-TOKEN")
+	if len(token) == 0 || bytes.Equal(token, req.Header.Peek("X-CSRF-TOKEN")) {
+		return resp, nil
+	}
+	storeCSRFToken(req, host, string(token))
+	req.Header.SetBytesV("X-CSRF-TOKEN", token)
+	fasthttp.ReleaseResponse(resp)
+	rlog(ctx, map[string]any{"at": "csrf_retry", "level": "debug", "host": host})
+	return upstreamDo(ctx, req, timeout)
+}
+
+func upstreamDo(ctx *fasthttp.RequestCtx, req *fasthttp.Request, timeout time.Duration) (*fasthttp.Response, error) {
+	resp, won, err := hedgedDo(req, timeout)
+	if won > 0 {
+		rlog(ctx, map[string]any{"at": "hedge", "level": "debug", "after_ms": hedgeAfterMs, "won": won})
+	}
+	return resp, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var enableDebugVars = getEnvBool("ENABLE_DEBUG_VARS")
+
+// proxyServer is the main listener, kept for its open connection count.
+var proxyServer *fasthttp.Server
+
+func init() {
+	if enableDebugVars && metricsKey == "" {
+		configError("ENABLE_DEBUG_VARS", errors.New("METRICS_KEY must be set to guard /debug/vars"))
+	}
+}
+
+// debugVarsHandler serves a JSON snapshot of runtime and proxy counters at
+// /debug/vars. It reports whether the request path was /debug/vars.
+func debugVarsHandler(ctx *fasthttp.RequestCtx) bool {
+	if !enableDebugVars || string(ctx.Path()) != "/debug/vars" {
+		return false
+	}
+	if !adminAuthorized(ctx) {
+		return true
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var conns int32
+	if proxyServer != nil {
+		conns = proxyServer.GetOpenConnectionsCount()
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"uptime_seconds":     int64(time.Since(startTime).Seconds()),
+		"goroutines":         runtime.NumGoroutine(),
+		"heap_alloc_bytes":   mem.HeapAlloc,
+		"heap_sys_bytes":     mem.HeapSys,
+		"heap_objects":       mem.HeapObjects,
+		"gc_runs":            mem.NumGC,
+		"gc_pause_total_ns":  mem.PauseTotalNs,
+		"gc_last_pause_ns":   mem.PauseNs[(mem.NumGC+255)%256],
+		"requests_total":     metrics.requests.Load(),
+		"retries_total":      totalRetries(),
+		"in_flight":          inFlight.Load(),
+		"active_connections": conns,
+	})
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
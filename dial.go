@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpproxy"
+	netproxy "golang.org/x/net/proxy"
+)
+
+var dialTimeout = startupConf.DialTimeout
+var egressProxy = parseEgressProxy(getEnv("EGRESS_PROXY"))
+var egressIPs = getEnvList("EGRESS_IPS", "")
+
+var egressNext atomic.Uint64
+
+func parseEgressProxy(raw string) *url.URL {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		configError("EGRESS_PROXY", errors.New("expected scheme://[user:pass@]host:port"))
+		return nil
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+		return u
+	}
+	configError("EGRESS_PROXY", errors.New("scheme must be http, socks5 or socks5h"))
+	return nil
+}
+
+func init() {
+	if egressProxy != nil && len(egressIPs) > 0 {
+		configError("EGRESS_IPS", errors.New("can't be combined with EGRESS_PROXY"))
+	}
+}
+
+// newDialer returns the dial function for upstream connections. Dials,
+// through an egress proxy or not, are bounded by DIAL_TIMEOUT so a slow
+// handshake fails over to the retry loop instead of eating the read
+// timeout. DNS_CACHE_TTL_SEC only applies to direct dials; an egress proxy
+// resolves upstream hosts itself.
+func newDialer() fasthttp.DialFunc {
+	timeout := time.Duration(dialTimeout) * time.Second
+	if egressProxy == nil {
+		if sources := usableEgressIPs(); len(sources) > 0 {
+			return func(addr string) (net.Conn, error) {
+				src := sources[egressNext.Add(1)%uint64(len(sources))]
+				d := net.Dialer{Timeout: timeout, LocalAddr: src}
+				return dialResolved(addr, timeout, func(addr string) (net.Conn, error) {
+					return d.Dial("tcp", addr)
+				})
+			}
+		}
+		return func(addr string) (net.Conn, error) {
+			return dialResolved(addr, timeout, func(addr string) (net.Conn, error) {
+				return fasthttp.DialTimeout(addr, timeout)
+			})
+		}
+	}
+	if egressProxy.Scheme == "http" {
+		proxy := egressProxy.Host
+		if user := egressProxy.User; user != nil {
+			pass, _ := user.Password()
+			proxy = user.Username() + ":" + pass + "@" + proxy
+		}
+		return fasthttpproxy.FasthttpHTTPDialerTimeout(proxy, timeout)
+	}
+	dialer, err := netproxy.FromURL(egressProxy, &net.Dialer{Timeout: timeout})
+	return func(addr string) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return dialer.(netproxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+}
+
+// usableEgressIPs resolves EGRESS_IPS to local addresses, skipping any that
+// aren't assigned to this host.
+func usableEgressIPs() []*net.TCPAddr {
+	if len(egressIPs) == 0 {
+		return nil
+	}
+	assigned := map[string]bool{}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				assigned[ipnet.IP.String()] = true
+			}
+		}
+	}
+
+	var sources []*net.TCPAddr
+	for _, raw := range egressIPs {
+		ip := net.ParseIP(raw)
+		if ip == nil || !assigned[ip.String()] {
+			jlog(map[string]any{"at": "egress_ip_skipped", "level": "warn", "ip": raw})
+			continue
+		}
+		sources = append(sources, &net.TCPAddr{IP: ip})
+	}
+	return sources
+}
+
+// egressProxyRedacted describes the egress proxy for logs, without its
+// password.
+func egressProxyRedacted() string {
+	if egressProxy == nil {
+		return ""
+	}
+	return egressProxy.Redacted()
+}
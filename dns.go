@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var dnsCacheTTLSec = getEnvInt("DNS_CACHE_TTL_SEC", 0)
+var dnsStaleSec = getEnvInt("DNS_STALE_SEC", 60)
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var (
+	dnsMu     sync.Mutex
+	dnsCache  = map[string]dnsEntry{}
+	dnsHits   atomic.Int64
+	dnsMisses atomic.Int64
+	dnsStale  atomic.Int64
+)
+
+func startDNSCache() {
+	go func() {
+		for range time.Tick(60 * time.Second) {
+			dnsMu.Lock()
+			entries := len(dnsCache)
+			dnsMu.Unlock()
+			jlog(map[string]any{
+				"at":      "dns_cache",
+				"hits":    dnsHits.Load(),
+				"misses":  dnsMisses.Load(),
+				"stale":   dnsStale.Load(),
+				"entries": entries,
+			})
+		}
+	}()
+}
+
+// dialResolved dials addr through dial, trying each of the host's cached
+// addresses in the order the resolver gave them until one connects, as
+// net.Dialer does for an uncached host.
+func dialResolved(addr string, timeout time.Duration, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	addrs, err := resolveAddr(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn net.Conn
+		if conn, err = dial(a); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveAddr swaps the host in addr for its cached IPs. A failed lookup
+// falls back to an expired entry for up to DNS_STALE_SEC so a resolver blip
+// doesn't fail every request, and only errors once nothing usable is left.
+func resolveAddr(addr string, timeout time.Duration) ([]string, error) {
+	if dnsCacheTTLSec <= 0 {
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+
+	now := time.Now()
+	dnsMu.Lock()
+	entry, ok := dnsCache[host]
+	dnsMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		dnsHits.Add(1)
+		return joinIPs(entry.ips, port), nil
+	}
+
+	dnsMisses.Add(1)
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(c, host)
+	if err != nil || len(addrs) == 0 {
+		if ok && now.Before(entry.expires.Add(time.Duration(dnsStaleSec)*time.Second)) {
+			dnsStale.Add(1)
+			return joinIPs(entry.ips, port), nil
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	dnsMu.Lock()
+	dnsCache[host] = dnsEntry{ips: ips, expires: now.Add(time.Duration(dnsCacheTTLSec) * time.Second)}
+	dnsMu.Unlock()
+	return joinIPs(ips, port), nil
+}
+
+func joinIPs(ips []net.IP, port string) []string {
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var drainDelaySec = getEnvNonNegativeInt("DRAIN_DELAY_SEC", 10)
+
+// draining fails readiness; refusing, set DRAIN_DELAY_SEC later, also
+// turns away new proxy requests.
+var draining atomic.Bool
+var refusing atomic.Bool
+var drainGen atomic.Int64
+
+// startDrain marks the instance not ready and, after DRAIN_DELAY_SEC to let
+// load balancers notice, starts refusing new requests. drain_end is logged
+// once in-flight requests have finished.
+func startDrain(source string) {
+	if draining.Swap(true) {
+		return
+	}
+	gen := drainGen.Add(1)
+	jlog(map[string]any{"at": "drain_begin", "source": source, "delay_sec": drainDelaySec, "in_flight": inFlight.Load()})
+	go func() {
+		time.Sleep(time.Duration(drainDelaySec) * time.Second)
+		if drainGen.Load() != gen {
+			return // cancelled
+		}
+		refusing.Store(true)
+		for inFlight.Load() > 0 && drainGen.Load() == gen {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if drainGen.Load() == gen {
+			jlog(map[string]any{"at": "drain_end", "source": source})
+		}
+	}()
+}
+
+// stopDrain returns a draining instance to service.
+func stopDrain(source string) {
+	if !draining.Load() {
+		return
+	}
+	drainGen.Add(1)
+	refusing.Store(false)
+	draining.Store(false)
+	jlog(map[string]any{"at": "drain_cancelled", "source": source})
+}
+
+// refuseDraining writes a 503 and reports true once a drain has started
+// refusing requests.
+func refuseDraining(ctx *fasthttp.RequestCtx) bool {
+	if !refusing.Load() {
+		return false
+	}
+	setError(&ctx.Response, 503, "draining", "Instance is draining.")
+	ctx.Response.Header.Set("Retry-After", "1")
+	ctx.SetConnectionClose()
+	return true
+}
+
+// drainHandler serves /admin/drain: POST starts draining, DELETE cancels
+// it and GET reports the state. It reports whether the path matched.
+func drainHandler(ctx *fasthttp.RequestCtx) bool {
+	if string(ctx.Path()) != "/admin/drain" {
+		return false
+	}
+	if !adminWriteAuthorized(ctx) {
+		return true
+	}
+	switch {
+	case ctx.IsPost():
+		startDrain("admin")
+	case ctx.IsDelete():
+		stopDrain("admin")
+	case !ctx.IsGet():
+		setError(&ctx.Response, 405, "method_not_allowed", "Method not allowed.")
+		return true
+	}
+	b, _ := json.Marshal(map[string]any{"draining": draining.Load(), "refusing": refusing.Load(), "in_flight": inFlight.Load()})
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
+
+// handleSIGUSR1 starts draining on SIGUSR1.
+func handleSIGUSR1() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		startDrain("signal")
+	}
+}
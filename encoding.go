@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var negotiateEncoding = getEnvBool("NEGOTIATE_ENCODING")
+var compressLocal = getEnvString("COMPRESS_LOCAL", "true") == "true"
+var compressLocalMinBytes = getEnvNonNegativeInt("COMPRESS_LOCAL_MIN_BYTES", 1024)
+
+// withLocalCompression wraps h to gzip the responses the proxy generates
+// itself, such as errors, batch results and metrics, when the client
+// accepts gzip and the body is at least COMPRESS_LOCAL_MIN_BYTES. Upstream
+// responses, marked by requestHandler, are left alone.
+func withLocalCompression(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if !compressLocal {
+		return h
+	}
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+		resp := &ctx.Response
+		if ctx.UserValue("upstream_response") != nil || ctx.IsHead() || resp.IsBodyStream() ||
+			len(resp.Header.ContentEncoding()) > 0 || len(resp.Body()) < compressLocalMinBytes ||
+			!acceptsEncoding(string(ctx.Request.Header.Peek("Accept-Encoding")), "gzip") {
+			return
+		}
+		resp.SetBody(fasthttp.AppendGzipBytes(nil, resp.Body()))
+		resp.Header.SetContentEncoding("gzip")
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// decodeForClient leaves a compressed body untouched when the client's
+// Accept-Encoding allows it and decodes it otherwise, which covers cache
+// hits stored for another client and upstreams that ignore the header. The
+// proxy never compresses upstream bodies itself, so nothing is encoded
+// twice.
+func decodeForClient(ctx *fasthttp.RequestCtx, response *fasthttp.Response) {
+	enc := strings.ToLower(string(response.Header.ContentEncoding()))
+	if enc == "" || enc == "identity" || acceptsEncoding(string(ctx.Request.Header.Peek("Accept-Encoding")), enc) {
+		return
+	}
+	body, err := response.BodyUncompressed()
+	if err != nil {
+		rlog(ctx, map[string]any{"at": "decode_failed", "level": "warn", "encoding": enc, "err": err.Error()})
+		return
+	}
+	response.SetBody(body)
+	response.Header.Del("Content-Encoding")
+}
+
+// acceptsEncoding reports whether an Accept-Encoding value allows enc,
+// honouring q=0 and the * wildcard.
+func acceptsEncoding(header string, enc string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != enc && name != "*" {
+			continue
+		}
+		ok := true
+		for _, p := range strings.Split(params, ";") {
+			if k, v, found := strings.Cut(strings.TrimSpace(p), "="); found && strings.EqualFold(k, "q") {
+				ok = strings.Trim(strings.TrimSpace(v), "0.") != ""
+			}
+		}
+		if name == enc {
+			return ok
+		}
+		wildcard = ok
+	}
+	return wildcard
+}
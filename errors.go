@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/valyala/fasthttp"
+)
+
+var errorFormatJSON = getEnvString("ERROR_FORMAT", "text") == "json"
+
+// setError writes a proxy-generated error to resp, as plain text or as a
+// JSON object depending on ERROR_FORMAT. Upstream bodies never pass through
+// here.
+func setError(resp *fasthttp.Response, status int, code string, message string) {
+	resp.SetStatusCode(status)
+	if !errorFormatJSON {
+		resp.Header.SetContentType("text/plain; charset=utf-8")
+		resp.SetBodyString(message)
+		return
+	}
+	b, _ := json.Marshal(map[string]any{"error": code, "message": message, "status": status})
+	resp.Header.SetContentType("application/json")
+	resp.SetBody(b)
+}
+
+func errorResponse(status int, code string, message string) *fasthttp.Response {
+	r := fasthttp.AcquireResponse()
+	setError(r, status, code, message)
+	return r
+}
+
+// upstreamErrorResponse is the 502 for an upstream request that failed
+// without a response, tagged with the error's classification.
+func upstreamErrorResponse(class string) *fasthttp.Response {
+	r := errorResponse(502, "upstream_error", "upstream request failed")
+	r.Header.Set("X-Proxy-Error-Class", class)
+	return r
+}
+
+// exhaustedResponse reports running out of retries after the last attempt
+// failed with err: a 504 if it timed out, or when there was no error, and a
+// 502 for anything else.
+func exhaustedResponse(err error) *fasthttp.Response {
+	if err == nil || isTimeout(err) {
+		r := errorResponse(504, "upstream_timeout", "upstream timeout")
+		if err != nil {
+			r.Header.Set("X-Proxy-Error-Class", errorClass(err))
+		}
+		return r
+	}
+	class := errorClass(err)
+	r := errorResponse(502, "upstream_error", "upstream request failed ("+class+")")
+	r.Header.Set("X-Proxy-Error-Class", class)
+	return r
+}
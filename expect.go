@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var expectContinue = getEnvBool("EXPECT_CONTINUE")
+
+// continuePreflight decides, from the headers alone, whether to send a
+// client's Expect: 100-continue upload the go-ahead. Requests the handler
+// would turn away anyway, for a bad key, method, host or path, or a body
+// over MAX_REQUEST_BYTES, get a 417 before any of the body is sent.
+// Checks needing the connection, such as client certificates and rate
+// limits, still happen in requestHandler. This is a local gate only: the
+// proxy has the whole body before it calls the upstream, so the
+// expectation isn't passed on.
+func continuePreflight(h *fasthttp.RequestHeader) bool {
+	reason := continueRejection(h)
+	fields := map[string]any{"at": "expect_continue", "level": "debug", "uri": string(h.RequestURI()), "accepted": reason == ""}
+	if reason != "" {
+		fields["reason"] = reason
+	}
+	jlog(fields)
+	if reason != "" {
+		// The client may send the body regardless; closing the connection
+		// keeps it from being parsed as the next request.
+		h.SetConnectionClose()
+	}
+	return reason == ""
+}
+
+func continueRejection(h *fasthttp.RequestHeader) string {
+	// Batches and the admin endpoints are served locally, so there is no
+	// target to check; the admin ones are guarded by METRICSKEY instead.
+	local, _, _ := strings.Cut(string(h.RequestURI()), "?")
+	if adminPort == "" && localAdminPath(local) {
+		return ""
+	}
+	if keys := conf().ProxyKeys; keys != nil && !mtlsOrKey && matchKey(keys, h.Peek("PROXYKEY")) == "" {
+		return "auth"
+	}
+	if !allowedMethods[string(h.Method())] {
+		return "method"
+	}
+	if h.ContentLength() > maxRequestBytes {
+		return "too_large"
+	}
+	if local == "/batch" {
+		return ""
+	}
+	var host, path string
+	ok := false
+	if hostFromHeader {
+		host = strings.ToLower(string(h.Peek(targetHostHeader)))
+		path, ok = strings.TrimPrefix(string(h.RequestURI()), "/"), validHost(host)
+	} else {
+		host, path, ok = splitTarget(string(h.RequestURI()))
+	}
+	switch {
+	case !ok:
+		return "invalid_target"
+	case !hostAllowed(host):
+		return "host_not_allowed"
+	case blockedPathPattern(host, upstreamPath(path)) != "":
+		return "path_blocked"
+	}
+	return ""
+}
+
+// localAdminPath reports whether path may be one of the endpoints
+// adminHandler serves.
+func localAdminPath(path string) bool {
+	return path == healthPath || path == readyPath || path == metricsPath ||
+		strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var failoverHosts = getEnvFailoverHosts("FAILOVER_HOSTS")
+
+type hostHealth struct {
+	failures    int
+	lastFailure time.Time
+}
+
+var hostFailuresMu sync.Mutex
+var hostFailures = map[string]*hostHealth{}
+
+// getEnvFailoverHosts parses comma-separated host=alternate|alternate...
+// entries, such as "apis.roblox.com=apis-a.example.com|apis-b.example.com".
+func getEnvFailoverHosts(key string) map[string][]string {
+	hosts := map[string][]string{}
+	for _, item := range getEnvList(key, "") {
+		primary, alts, ok := strings.Cut(item, "=")
+		primary = strings.ToLower(strings.TrimSpace(primary))
+		if !ok || !validHost(primary) {
+			configError(key, fmt.Errorf("invalid entry %q, want host=alternate|alternate", item))
+			continue
+		}
+		for _, alt := range strings.Split(alts, "|") {
+			alt = strings.ToLower(strings.TrimSpace(alt))
+			if !validHost(alt) {
+				configError(key, fmt.Errorf("entry %q: invalid alternate %q", item, alt))
+				continue
+			}
+			hosts[primary] = append(hosts[primary], alt)
+		}
+	}
+	return hosts
+}
+
+// failoverOrder returns the hosts to try for a request to host: host itself
+// and its FAILOVER_HOSTS alternates, those with the fewest consecutive
+// failures first and in configured order otherwise. Failures are forgotten
+// CB_RESET_SEC after the last one, so a recovered primary is used again.
+func failoverOrder(host string) []string {
+	alts, ok := failoverHosts[strings.ToLower(host)]
+	if !ok {
+		return []string{host}
+	}
+	order := append([]string{host}, alts...)
+	hostFailuresMu.Lock()
+	defer hostFailuresMu.Unlock()
+	slices.SortStableFunc(order, func(a, b string) int {
+		return recentFailures(a) - recentFailures(b)
+	})
+	return order
+}
+
+func recentFailures(host string) int {
+	h, ok := hostFailures[host]
+	if !ok || time.Since(h.lastFailure) > time.Duration(cbResetSec)*time.Second {
+		return 0
+	}
+	return h.failures
+}
+
+// recordHostHealth tracks consecutive failures for hosts taking part in
+// failover, so failoverOrder can put healthy ones first.
+func recordHostHealth(host string, failed bool) {
+	if len(failoverHosts) == 0 {
+		return
+	}
+	hostFailuresMu.Lock()
+	defer hostFailuresMu.Unlock()
+	if failed {
+		h, ok := hostFailures[host]
+		if !ok {
+			h = &hostHealth{}
+			hostFailures[host] = h
+		}
+		h.failures++
+		h.lastFailure = time.Now()
+	} else {
+		delete(hostFailures, host)
+	}
+}
+
+// failover moves st on to the next host in its failover order with a fresh
+// set of attempts, and reports false when there's none left to try.
+func (st *attemptState) failover(ctx *fasthttp.RequestCtx, reason string) bool {
+	if len(st.hosts) == 0 {
+		return false
+	}
+	from := st.host
+	st.host, st.hosts = st.hosts[0], st.hosts[1:]
+	st.attempt = 1
+	st.lastErr = nil
+	ctx.SetUserValue("upstream_host", st.host)
+	rlog(ctx, map[string]any{"at": "failover", "level": "warn", "from": from, "to": st.host, "reason": reason})
+	return true
+}
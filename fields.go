@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var fieldProjection = getEnvBool("FIELD_PROJECTION")
+
+// projectFields trims a 2xx JSON response down to the top-level fields
+// listed in the client's X-Proxy-Fields header, applied to each element
+// when the body is an array of objects. Streamed, compressed and non-JSON
+// bodies pass through untouched, as does anything that fails to parse.
+func projectFields(ctx *fasthttp.RequestCtx, response *fasthttp.Response) {
+	raw := string(ctx.Request.Header.Peek("X-Proxy-Fields"))
+	if !fieldProjection || raw == "" || ctx.IsHead() {
+		return
+	}
+	sc := response.StatusCode()
+	if sc < 200 || sc > 299 || response.IsBodyStream() || len(response.Header.ContentEncoding()) > 0 ||
+		!bytes.Contains(response.Header.ContentType(), []byte("json")) {
+		return
+	}
+	fields := splitList(raw)
+
+	body := response.Body()
+	var out any
+	var err error
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []map[string]json.RawMessage
+		if err = json.Unmarshal(body, &items); err == nil {
+			for i := range items {
+				items[i] = pickFields(items[i], fields)
+			}
+			out = items
+		}
+	} else {
+		var obj map[string]json.RawMessage
+		if err = json.Unmarshal(body, &obj); err == nil {
+			out = pickFields(obj, fields)
+		}
+	}
+	if err != nil {
+		rlog(ctx, map[string]any{"at": "fields_parse_failed", "level": "warn", "err": err.Error()})
+		return
+	}
+	projected, _ := json.Marshal(out)
+	rlog(ctx, map[string]any{"at": "fields_projected", "level": "debug", "fields": strings.Join(fields, ","), "bytes_in": len(body), "bytes_out": len(projected)})
+	response.SetBody(projected)
+}
+
+func pickFields(obj map[string]json.RawMessage, fields []string) map[string]json.RawMessage {
+	picked := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := obj[f]; ok {
+			picked[f] = v
+		}
+	}
+	return picked
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func getEnvHeaderValue(key string, fallback string) string {
+	v := getEnvString(key, fallback)
+	if !validHeaderValue(v) {
+		configError(key, errors.New("not a valid header value"))
+	}
+	return v
+}
+
+// validHeaderValue reports whether v may be sent as a header value: visible
+// ASCII, spaces and tabs only, so nothing can break out of the header line.
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+var stripResponseCookies = getEnvBool("STRIP_RESPONSE_COOKIES")
+var stripResponseHeaders = lowerList(getEnvList("STRIP_RESPONSE_HEADERS", ""))
+
+// strippedResponseHeader reports whether an upstream response header is
+// withheld from the client.
+func strippedResponseHeader(key []byte) bool {
+	name := strings.ToLower(string(key))
+	return slices.Contains(stripResponseHeaders, name) || stripResponseCookies && name == "set-cookie"
+}
+
+type headerPair struct {
+	name  string
+	value string
+}
+
+var addResponseHeaders = getEnvHeaderPairs("ADD_RESPONSE_HEADERS")
+
+// getEnvHeaderPairs parses a semicolon-separated list of "Name: Value"
+// headers.
+func getEnvHeaderPairs(key string) []headerPair {
+	var pairs []headerPair
+	for _, item := range strings.Split(getEnv(key), ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !validHeaderName(name) || !validHeaderValue(value) {
+			configError(key, fmt.Errorf("invalid header %q, want Name: Value", item))
+			continue
+		}
+		pairs = append(pairs, headerPair{name, value})
+	}
+	return pairs
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token.
+func validHeaderName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+var viaName = getEnvHeaderValue("VIA_NAME", "roproxy-lite")
+var disableVia = getEnvBool("DISABLE_VIA")
+var upstreamStatusHeader = getEnvHeaderName("UPSTREAM_STATUS_HEADER", "X-Proxy-Upstream-Status")
+var disableUpstreamStatus = getEnvBool("DISABLE_UPSTREAM_STATUS_HEADER")
+
+func getEnvHeaderName(key string, fallback string) string {
+	v := getEnvString(key, fallback)
+	if !validHeaderName(v) {
+		configError(key, errors.New("not a valid header name"))
+	}
+	return v
+}
+
+// appendVia adds this proxy as a hop to the response's Via chain, as
+// "<protocol version> VIA_NAME", after any hops the upstream listed.
+func appendVia(ctx *fasthttp.RequestCtx) {
+	if disableVia {
+		return
+	}
+	hop := strings.TrimPrefix(string(ctx.Request.Header.Protocol()), "HTTP/") + " " + viaName
+	if prior := ctx.Response.Header.Peek("Via"); len(prior) > 0 {
+		hop = string(prior) + ", " + hop
+	}
+	ctx.Response.Header.Set("Via", hop)
+}
+
+var debugHeaders = getEnvBool("DEBUG_HEADERS")
+
+// setDebugHeaders adds X-Proxy-Retries, the number of upstream attempts
+// made (absent when served from cache), X-Proxy-Duration-Ms, the time
+// spent so far, and Server-Timing, when DEBUG_HEADERS is on.
+func setDebugHeaders(ctx *fasthttp.RequestCtx) {
+	if !debugHeaders {
+		return
+	}
+	if n, ok := ctx.UserValue("attempts").(int); ok {
+		ctx.Response.Header.Set("X-Proxy-Retries", strconv.Itoa(n))
+	}
+	start := ctx.Time()
+	if start.IsZero() {
+		start = ctx.ConnTime() // batch sub-requests have no request time
+	}
+	total := time.Since(start)
+	ctx.Response.Header.Set("X-Proxy-Duration-Ms", strconv.FormatInt(total.Milliseconds(), 10))
+	ctx.Response.Header.Set("Server-Timing", serverTiming(ctx, total))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var startTime = time.Now()
+var healthPath = getEnvString("HEALTH_PATH", "/health")
+var readyPath = getEnvString("READY_PATH", "/ready")
+var readyDialHost = getEnv("READY_DIAL_HOST")
+
+// probeHandler answers liveness and readiness probes locally. It reports
+// whether the request path was a probe path.
+func probeHandler(ctx *fasthttp.RequestCtx) bool {
+	path := string(ctx.Path())
+	if path != healthPath && path != readyPath {
+		return false
+	}
+
+	status := "ok"
+	code := fasthttp.StatusOK
+	if path == readyPath {
+		if client == nil {
+			status, code = "client not initialized", fasthttp.StatusServiceUnavailable
+		} else if draining.Load() {
+			status, code = "draining", fasthttp.StatusServiceUnavailable
+		} else if readyDialHost != "" {
+			conn, err := fasthttp.DialTimeout(readyDialHost+":443", 2*time.Second)
+			if err != nil {
+				status, code = "upstream unreachable", fasthttp.StatusServiceUnavailable
+			} else {
+				conn.Close()
+			}
+		}
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"status":         status,
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	})
+	ctx.SetStatusCode(code)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var hedgeAfterMs = getEnvInt("HEDGE_AFTER_MS", 0)
+
+type hedgeResult struct {
+	resp *fasthttp.Response
+	err  error
+	n    int
+}
+
+// hedgedDo performs req and returns its response, which the caller must
+// release. With HEDGE_AFTER_MS, a GET or HEAD still outstanding after that
+// long is raced against one identical copy, and won reports which of the two
+// finished first (0 when no hedge was sent). fasthttp can't abort a request
+// in flight, so the loser runs to completion and is discarded.
+func hedgedDo(req *fasthttp.Request, timeout time.Duration) (resp *fasthttp.Response, won int, err error) {
+	if hedgeAfterMs <= 0 || !(req.Header.IsGet() || req.Header.IsHead()) {
+		resp = fasthttp.AcquireResponse()
+		return resp, 0, clientDo(req, resp, timeout)
+	}
+
+	results := make(chan hedgeResult, 2)
+	send := func(r *fasthttp.Request, n int) {
+		out := fasthttp.AcquireResponse()
+		err := clientDo(r, out, timeout)
+		fasthttp.ReleaseRequest(r)
+		results <- hedgeResult{out, err, n}
+	}
+	primary := fasthttp.AcquireRequest()
+	req.CopyTo(primary)
+	go send(primary, 1)
+
+	timer := time.NewTimer(time.Duration(hedgeAfterMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.resp, 0, r.err
+	case <-timer.C:
+	}
+
+	if !acquireHedgeSlot() {
+		r := <-results
+		return r.resp, 0, r.err
+	}
+	hedge := fasthttp.AcquireRequest()
+	req.CopyTo(hedge)
+	go func() {
+		send(hedge, 2)
+		releaseSlot()
+	}()
+
+	first := <-results
+	if first.err != nil {
+		// A failed request is no reason to drop the other one; wait for it
+		// and keep whichever actually produced a response.
+		second := <-results
+		if second.err == nil {
+			fasthttp.ReleaseResponse(first.resp)
+			return second.resp, second.n, nil
+		}
+		fasthttp.ReleaseResponse(second.resp)
+		return first.resp, first.n, first.err
+	}
+	go func() {
+		fasthttp.ReleaseResponse((<-results).resp)
+	}()
+	return first.resp, first.n, nil
+}
+
+// acquireHedgeSlot claims a MAX_CONCURRENT slot for a hedge, so hedging
+// never pushes the proxy past its concurrency limit.
+func acquireHedgeSlot() bool {
+	if concurrencySlots == nil {
+		return true
+	}
+	select {
+	case concurrencySlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "strings"
+
+var allowedHosts = lowerList(getEnvList("ALLOWED_HOSTS", ""))
+
+func lowerList(list []string) []string {
+	for i, item := range list {
+		list[i] = strings.ToLower(strings.TrimPrefix(item, "."))
+	}
+	return list
+}
+
+// hostAllowed reports whether host matches one of the ALLOWED_HOSTS
+// suffixes, or whether no allow-list is configured.
+func hostAllowed(host string) bool {
+	return len(allowedHosts) == 0 || hostMatches(host, allowedHosts)
+}
+
+// validHost reports whether host is non-empty and made only of letters,
+// digits, dots and hyphens, so tricks like "evil.com#roblox.com" or
+// "evil.com@roblox.com" can't slip through.
+func validHost(host string) bool {
+	for _, c := range strings.ToLower(host) {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			return false
+		}
+	}
+	return host != ""
+}
+
+// hostMatches reports whether host equals or is a subdomain of one of the
+// suffixes. Invalid hosts never match.
+func hostMatches(host string, suffixes []string) bool {
+	if !validHost(host) {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, suffix := range suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
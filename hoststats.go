@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Each host keeps its last hostStatsWindow upstream call durations, and at
+// most hostStatsMaxHosts hosts are tracked, the least recently called
+// making way for a new one, so memory stays bounded however many hosts are
+// proxied.
+const hostStatsWindow = 1024
+const hostStatsMaxHosts = 256
+
+type hostLatency struct {
+	host    string
+	count   int64
+	errors  int64
+	samples [hostStatsWindow]time.Duration
+	next    int
+	filled  bool
+}
+
+var hostStatsMu sync.Mutex
+var hostStatsLRU = list.New()
+var hostStats = map[string]*list.Element{}
+
+// observeHost records one upstream call to host.
+func observeHost(host string, d time.Duration, failed bool) {
+	hostStatsMu.Lock()
+	defer hostStatsMu.Unlock()
+	var h *hostLatency
+	if el, ok := hostStats[host]; ok {
+		h = el.Value.(*hostLatency)
+		hostStatsLRU.MoveToFront(el)
+	} else {
+		h = &hostLatency{host: host}
+		hostStats[host] = hostStatsLRU.PushFront(h)
+		if hostStatsLRU.Len() > hostStatsMaxHosts {
+			oldest := hostStatsLRU.Back()
+			hostStatsLRU.Remove(oldest)
+			delete(hostStats, oldest.Value.(*hostLatency).host)
+		}
+	}
+	h.count++
+	if failed {
+		h.errors++
+	}
+	h.samples[h.next] = d
+	h.next = (h.next + 1) % hostStatsWindow
+	h.filled = h.filled || h.next == 0
+}
+
+func (h *hostLatency) summary() map[string]any {
+	n := h.next
+	if h.filled {
+		n = hostStatsWindow
+	}
+	sorted := slices.Clone(h.samples[:n])
+	slices.Sort(sorted)
+	pct := func(p float64) float64 {
+		if n == 0 {
+			return 0
+		}
+		return float64(sorted[int(p*float64(n-1))].Microseconds()) / 1000
+	}
+	return map[string]any{
+		"requests": h.count,
+		"errors":   h.errors,
+		"window":   n,
+		"p50_ms":   pct(0.50),
+		"p95_ms":   pct(0.95),
+		"p99_ms":   pct(0.99),
+	}
+}
+
+// hostStatsHandler serves GET /admin/stats/hosts, upstream latency
+// percentiles over each host's recent calls. It reports whether the path
+// matched.
+func hostStatsHandler(ctx *fasthttp.RequestCtx) bool {
+	if string(ctx.Path()) != "/admin/stats/hosts" {
+		return false
+	}
+	if !adminAuthorized(ctx) {
+		return true
+	}
+	hostStatsMu.Lock()
+	out := make(map[string]any, len(hostStats))
+	for host, el := range hostStats {
+		out[host] = el.Value.(*hostLatency).summary()
+	}
+	hostStatsMu.Unlock()
+	b, _ := json.Marshal(out)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
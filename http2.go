@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var upstreamHTTP2 = getEnvBool("UPSTREAM_HTTP2")
+
+// h2Client sends upstream requests with UPSTREAM_HTTP2. fasthttp only
+// speaks HTTP/1.1, so this goes through net/http, which negotiates h2 over
+// ALPN and falls back to HTTP/1.1 on the same connection when the upstream
+// doesn't offer it.
+var h2Client *http.Client
+
+func newH2Client(dial fasthttp.DialFunc) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialTLS(ctx, dial, addr)
+			},
+			ForceAttemptHTTP2:   true,
+			DisableCompression:  true, // pass Content-Encoding through untouched, as fasthttp does
+			MaxConnsPerHost:     maxConnsPerHost,
+			IdleConnTimeout:     time.Duration(maxIdleConnDurationSec) * time.Second,
+			TLSHandshakeTimeout: time.Duration(dialTimeout) * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// dialTLS opens a TLS connection through the usual upstream dialer and logs
+// the protocol the upstream picked for it.
+func dialTLS(ctx context.Context, dial fasthttp.DialFunc, addr string) (net.Conn, error) {
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	cfg := &tls.Config{}
+	if upstreamTLSConfig != nil {
+		cfg = upstreamTLSConfig.Clone()
+	}
+	cfg.ServerName = host
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	proto := tc.ConnectionState().NegotiatedProtocol
+	if proto == "" {
+		proto = "http/1.1"
+	}
+	jlog(map[string]any{"at": "upstream_conn", "level": "debug", "addr": addr, "protocol": proto})
+	return tc, nil
+}
+
+// clientDo performs req into resp, over HTTP/2 with UPSTREAM_HTTP2 and with
+// the fasthttp client otherwise, giving up after d from start to finish. A
+// zero d means ATTEMPT_TIMEOUT_MS, and no limit when that's zero too.
+func clientDo(req *fasthttp.Request, resp *fasthttp.Response, d time.Duration) error {
+	if d == 0 {
+		d = time.Duration(attemptTimeoutMs) * time.Millisecond
+	}
+	if !upstreamHTTP2 {
+		if d == 0 {
+			return client.Do(req, resp)
+		}
+		return client.DoTimeout(req, resp, d)
+	}
+	if d < 0 {
+		return fasthttp.ErrTimeout
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if d > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), d)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	hr, err := http.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), bytes.NewReader(req.Body()))
+	if err != nil {
+		cancel()
+		return err
+	}
+	hr.Host = string(req.Header.Host())
+	req.Header.VisitAll(func(k, v []byte) {
+		if !bytes.EqualFold(k, []byte("Host")) {
+			hr.Header.Add(string(k), string(v))
+		}
+	})
+	hresp, err := h2Client.Do(hr)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	resp.SetStatusCode(hresp.StatusCode)
+	for k, vs := range hresp.Header {
+		for _, v := range vs {
+			resp.Header.Add(k, v)
+		}
+	}
+	if streamResponses {
+		// The body is read after clientDo returns, so the deadline has to
+		// outlive it; closing the stream releases it.
+		resp.SetBodyStream(&cancelingBody{hresp.Body, cancel}, int(hresp.ContentLength))
+		return nil
+	}
+	defer cancel()
+	defer hresp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(hresp.Body, int64(maxResponseBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxResponseBytes {
+		return fasthttp.ErrBodyTooLarge
+	}
+	resp.SetBody(body)
+	return nil
+}
+
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
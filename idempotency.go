@@ -0,0 +1,107 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var idempotencyTTLSec = getEnvInt("IDEMPOTENCY_TTL_SEC", 0)
+var idempotencyMaxEntries = getEnvPositiveInt("IDEMPOTENCY_MAX_ENTRIES", 1000)
+
+type idempotentCall struct {
+	key     string
+	done    chan struct{}
+	resp    *fasthttp.Response
+	expires time.Time
+}
+
+var idemMu sync.Mutex
+var idemLRU = list.New()
+var idemIndex = map[string]*list.Element{}
+
+func startIdempotencyEviction() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			now := time.Now()
+			idemMu.Lock()
+			for _, el := range idemIndex {
+				if call := el.Value.(*idempotentCall); call.resp != nil && now.After(call.expires) {
+					idemRemove(el)
+				}
+			}
+			idemMu.Unlock()
+		}
+	}()
+}
+
+// idemRemove drops el from the LRU and its index. The caller must hold
+// idemMu.
+func idemRemove(el *list.Element) {
+	idemLRU.Remove(el)
+	delete(idemIndex, el.Value.(*idempotentCall).key)
+}
+
+// idempotentRequest forwards a POST, PUT, PATCH or DELETE once per
+// Idempotency-Key. A repeat with the same key, proxy key, method and target
+// within IDEMPOTENCY_TTL_SEC gets a copy of the first response, waiting for
+// it if the first request is still in flight. A 5xx is shared with requests
+// that were already waiting but not kept, so a later retry goes upstream
+// again. At most IDEMPOTENCY_MAX_ENTRIES keys are kept, the least recently
+// used going first.
+func idempotentRequest(ctx *fasthttp.RequestCtx, upHost string, upPath string) *fasthttp.Response {
+	header := ctx.Request.Header.Peek("Idempotency-Key")
+	safe := ctx.IsGet() || ctx.IsHead() || ctx.IsOptions()
+	if idempotencyTTLSec <= 0 || len(header) == 0 || safe {
+		return coalescedRequest(ctx, upHost, upPath)
+	}
+	label, _ := ctx.UserValue("key_label").(string)
+	key := label + "\x00" + string(ctx.Method()) + " " + upHost + "/" + upPath + "\x00" + string(header)
+
+	idemMu.Lock()
+	var call *idempotentCall
+	el, ok := idemIndex[key]
+	if ok {
+		call = el.Value.(*idempotentCall)
+		if call.resp != nil && time.Now().After(call.expires) {
+			idemRemove(el)
+			ok = false
+		} else {
+			idemLRU.MoveToFront(el)
+		}
+	}
+	if !ok {
+		call = &idempotentCall{key: key, done: make(chan struct{})}
+		idemIndex[key] = idemLRU.PushFront(call)
+		for idemLRU.Len() > idempotencyMaxEntries {
+			idemRemove(idemLRU.Back())
+		}
+	}
+	idemMu.Unlock()
+
+	if ok {
+		<-call.done
+		rlog(ctx, map[string]any{"at": "idempotent_replay", "level": "debug", "status": call.resp.StatusCode()})
+		r := fasthttp.AcquireResponse()
+		call.resp.CopyTo(r)
+		r.Header.Set("Idempotent-Replayed", "true")
+		return r
+	}
+
+	resp := coalescedRequest(ctx, upHost, upPath)
+	resp.Body() // buffers a streamed body so it can be copied
+	stored := &fasthttp.Response{}
+	resp.CopyTo(stored)
+
+	idemMu.Lock()
+	call.resp = stored
+	call.expires = time.Now().Add(time.Duration(idempotencyTTLSec) * time.Second)
+	if el, ok := idemIndex[key]; ok && stored.StatusCode() >= 500 && el.Value == call {
+		idemRemove(el)
+	}
+	idemMu.Unlock()
+	close(call.done)
+	return resp
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/valyala/fasthttp"
+)
+
+var maxResponseBytes = getEnvPositiveInt("MAX_RESPONSE_BYTES", 64<<20)
+var maxRequestBytes = getEnvPositiveInt("MAX_REQUEST_BYTES", 16<<20)
+
+// requestTooLarge writes a 413 when the client body exceeds
+// MAX_REQUEST_BYTES. It reports whether the request was rejected.
+func requestTooLarge(ctx *fasthttp.RequestCtx) bool {
+	size := max(ctx.Request.Header.ContentLength(), len(ctx.Request.Body()))
+	if size <= maxRequestBytes {
+		return false
+	}
+	rlog(ctx, map[string]any{"at": "request_too_large", "level": "warn", "bytes": size, "limit": maxRequestBytes})
+	setError(&ctx.Response, 413, "request_too_large", "Request body too large.")
+	return true
+}
+
+// serverError handles errors fasthttp hits before the handler runs, most
+// notably bodies over MAX_REQUEST_BYTES, which it refuses to read.
+func serverError(ctx *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		jlog(map[string]any{"at": "request_too_large", "level": "warn", "limit": maxRequestBytes, "remote": clientIP(ctx).String()})
+		setError(&ctx.Response, 413, "request_too_large", "Request body too large.")
+		return
+	}
+	var smallBuf *fasthttp.ErrSmallBuffer
+	var netErr *net.OpError
+	switch {
+	case errors.As(err, &smallBuf):
+		setError(&ctx.Response, 431, "header_too_large", "Too big request header")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		jlog(map[string]any{"at": "slow_client_dropped", "level": "warn", "remote": ctx.RemoteIP().String()})
+		setError(&ctx.Response, 408, "request_timeout", "Request timeout")
+	default:
+		setError(&ctx.Response, 400, "bad_request", "Error when parsing request")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/prefork"
+)
+
+var listenSocket = getEnv("LISTEN_SOCKET")
+var listenSocketMode = getEnvFileMode("LISTEN_SOCKET_MODE", 0660)
+var listenAddr = getEnvListenAddr("LISTEN_ADDR")
+
+// Client connection tunables. Zero leaves fasthttp's default: keep-alive
+// on, unlimited requests and connections, and an idle timeout equal to the
+// read timeout.
+var disableKeepalive = getEnvBool("DISABLE_KEEPALIVE")
+var maxRequestsPerConn = getEnvNonNegativeInt("MAX_REQUESTS_PER_CONN", 0)
+var idleTimeoutSec = getEnvNonNegativeInt("IDLE_TIMEOUT_SEC", 0)
+var maxConnsPerIP = getEnvNonNegativeInt("MAX_CONNS_PER_IP", 0)
+
+// CLIENT_READ_TIMEOUT_SEC bounds reading each request, from its first byte
+// through the end of its headers and, unless CLIENT_BODY_TIMEOUT_SEC is set,
+// its body. Without IDLE_TIMEOUT_SEC it also bounds keep-alive idle time.
+// Zero means no limit.
+var clientReadTimeoutSec = getEnvNonNegativeInt("CLIENT_READ_TIMEOUT_SEC", 0)
+var clientBodyTimeoutSec = getEnvNonNegativeInt("CLIENT_BODY_TIMEOUT_SEC", 0)
+
+// bodyReadDeadline gives each request CLIENT_BODY_TIMEOUT_SEC, counted from
+// the end of its headers, to send its body.
+func bodyReadDeadline(*fasthttp.RequestHeader) fasthttp.RequestConfig {
+	return fasthttp.RequestConfig{ReadTimeout: time.Duration(clientBodyTimeoutSec) * time.Second}
+}
+
+func init() {
+	if maxConnsPerIP > 0 && proxyProtocol {
+		// fasthttp counts by address at accept time, before the PROXY
+		// header has been read, which would stall every accept.
+		configError("MAX_CONNS_PER_IP", errors.New("can't be combined with PROXY_PROTOCOL"))
+	}
+}
+
+// getEnvListenAddr reads an IP address to bind to. Empty means all
+// interfaces.
+func getEnvListenAddr(key string) string {
+	val := getEnv(key)
+	if val != "" && net.ParseIP(val) == nil {
+		configError(key, fmt.Errorf("invalid IP address %q", val))
+		return ""
+	}
+	return val
+}
+
+// bindAddr joins LISTEN_ADDR with a port for net.Listen.
+func bindAddr(port string) string {
+	return net.JoinHostPort(listenAddr, port)
+}
+
+func getEnvFileMode(key string, fallback os.FileMode) os.FileMode {
+	val := getEnv(key)
+	if val == "" {
+		return fallback
+	}
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil {
+		configError(key, fmt.Errorf("invalid octal file mode %q", val))
+		return fallback
+	}
+	return os.FileMode(mode)
+}
+
+func listenerType() string {
+	if listenSocket != "" {
+		return "unix"
+	}
+	if tlsEnabled() {
+		return "tls"
+	}
+	return "tcp"
+}
+
+// serve binds the configured listener and serves until server is shut
+// down. A stale socket file left by a previous run is replaced.
+func serve(server *fasthttp.Server) error {
+	if listenSocket != "" {
+		return server.ListenAndServeUNIX(listenSocket, listenSocketMode)
+	}
+	if preforkEnabled {
+		p := prefork.New(server)
+		p.Network = "tcp"
+		p.ServeFunc = func(ln net.Listener) error {
+			return server.Serve(wrapListener(ln))
+		}
+		if prefork.IsChild() {
+			go watchParent()
+		}
+		return p.ListenAndServe(bindAddr(port))
+	}
+	if tlsEnabled() || proxyProtocol {
+		ln, err := net.Listen("tcp", bindAddr(port))
+		if err != nil {
+			return err
+		}
+		return server.Serve(wrapListener(ln))
+	}
+	return server.ListenAndServe(bindAddr(port))
+}
+
+// wrapListener layers PROXY protocol parsing, which has to see the raw
+// connection, under TLS.
+func wrapListener(ln net.Listener) net.Listener {
+	if proxyProtocol {
+		ln = proxyProtoListener{ln}
+	}
+	if tlsEnabled() {
+		ln = tls.NewListener(ln, serverTLSConfig())
+	}
+	return ln
+}
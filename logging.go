@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+)
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+var logBodyMaxBytes = getEnvPositiveInt("LOG_BODY_MAX_BYTES", 1024)
+var logBodyRedact = getEnvRegexp("LOG_BODY_REDACT_PATTERN", `(?i)login|logout|auth|password|token|cookie`)
+var logFormat = getEnvString("LOG_FORMAT", "json")
+
+func init() {
+	switch logFormat {
+	case "json", "text", "none":
+	default:
+		configError("LOG_FORMAT", fmt.Errorf("must be json, text or none, got %q", logFormat))
+	}
+}
+
+func getEnvRegexp(key string, fallback string) *regexp.Regexp {
+	re, err := regexp.Compile(getEnvString(key, fallback))
+	if err != nil {
+		configError(key, err)
+		return nil
+	}
+	return re
+}
+
+func getEnvLogLevel(key string, fallback string) int {
+	name := getEnvString(key, fallback)
+	rank, ok := logLevels[name]
+	if !ok {
+		configError(key, fmt.Errorf("unknown level %q", name))
+		return logLevels[fallback]
+	}
+	return rank
+}
+
+// jlog writes fields as a single JSON line, unless its "level" (info when
+// unset) is below LOG_LEVEL.
+func jlog(fields map[string]any) {
+	level, _ := fields["level"].(string)
+	if level == "" {
+		level = "info"
+		fields["level"] = level
+	}
+	if logLevels[level] < conf().LogLevel {
+		return
+	}
+	writeLog(fields)
+}
+
+// writeLog writes fields regardless of LOG_LEVEL, as JSON or, with
+// LOG_FORMAT=text, as a single key=value line.
+func writeLog(fields map[string]any) {
+	if logFormat == "text" {
+		log.Println(textLine(fields))
+		return
+	}
+	b, _ := json.Marshal(fields)
+	log.Println(string(b))
+}
+
+// textLine renders fields as "at key=value ...", with keys sorted. A
+// request_end record leads with "method uri status duration remote"
+// instead of its at field.
+func textLine(fields map[string]any) string {
+	lead := []string{"at"}
+	if fields["at"] == "request_end" {
+		lead = []string{"method", "uri", "status", "duration", "remote"}
+	}
+	var b strings.Builder
+	for i, k := range lead {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(textValue(fields[k]))
+		if k == "duration" {
+			b.WriteString("ms")
+		}
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if !slices.Contains(lead, k) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b.WriteString(" " + k + "=" + textValue(fields[k]))
+	}
+	return b.String()
+}
+
+func textValue(v any) string {
+	s, ok := v.(string)
+	if !ok {
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// rlog is jlog for records about a single request, tagged for correlation.
+func rlog(ctx *fasthttp.RequestCtx, fields map[string]any) {
+	if id, ok := ctx.UserValue("request_id").(string); ok {
+		fields["request_id"] = id
+	}
+	if id, ok := ctx.UserValue("trace_id").(string); ok {
+		fields["trace_id"] = id
+	}
+	if label, ok := ctx.UserValue("key_label").(string); ok {
+		fields["key"] = label
+	}
+	if ip, ok := ctx.UserValue("source_ip").(string); ok {
+		fields["source_ip"] = ip
+	}
+	if cn, ok := ctx.UserValue("client_cn").(string); ok {
+		fields["client_cn"] = cn
+	}
+	jlog(fields)
+}
+
+// addBodies attaches truncated request and response bodies to a
+// request_end record. Streamed responses are left unread.
+func addBodies(ctx *fasthttp.RequestCtx, fields map[string]any) {
+	if logBodyRedact != nil && logBodyRedact.Match(ctx.Path()) {
+		fields["bodies"] = "redacted"
+		return
+	}
+	fields["request_body"] = bodySnippet(ctx.Request.Body())
+	if ctx.Response.IsBodyStream() {
+		fields["response_body"] = "streamed"
+	} else {
+		fields["response_body"] = bodySnippet(ctx.Response.Body())
+	}
+}
+
+// bodySnippet truncates b to LOG_BODY_MAX_BYTES, base64-encoding it unless
+// it is valid UTF-8.
+func bodySnippet(b []byte) string {
+	if len(b) > logBodyMaxBytes {
+		b = b[:logBodyMaxBytes]
+		// Drop a multi-byte character split by the cut.
+		for i := 1; i < utf8.UTFMax && !utf8.Valid(b); i++ {
+			b = b[:len(b)-1]
+		}
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return "base64:" + base64.StdEncoding.EncodeToString(b)
+}
+
+func statusLevel(status int) string {
+	switch {
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "warn"
+	}
+	return "info"
+}
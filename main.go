@@ -1,9 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"os"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -11,68 +13,421 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
-var timeout = getEnvInt("TIMEOUT", 15)
-var retries = getEnvInt("RETRIES", 5)
-var port = os.Getenv("PORT")
-var logSlowMs = getEnvInt("LOG_SLOW_MS", 300)
-var logErrorsOnly = os.Getenv("LOG_ERRORS_ONLY") == "true"
+var timeout = startupConf.Timeout
+var port = getEnvPort("PORT", "8080")
+var maxConnsPerHost = startupConf.MaxConnsPerHost
+var maxIdleConnDurationSec = startupConf.MaxIdleConnDurationSec
+var writeTimeout = startupConf.WriteTimeout
+var totalDeadlineMs = getEnvInt("TOTAL_DEADLINE_MS", 0)
+var attemptTimeoutMs = getEnvNonNegativeInt("ATTEMPT_TIMEOUT_MS", timeout*1000)
+var clientTimeoutMinMs = getEnvNonNegativeInt("CLIENT_TIMEOUT_MIN_MS", 100)
+var clientTimeoutMaxMs = getEnvNonNegativeInt("CLIENT_TIMEOUT_MAX_MS", 60000)
+var maxClientRetries = getEnvNonNegativeInt("MAX_CLIENT_RETRIES", 10)
+var forwardClientIP = getEnvBool("FORWARD_CLIENT_IP")
+var userAgent = getEnvHeaderValue("UPSTREAM_USER_AGENT", "RoProxy")
+var preserveClientUA = getEnvBool("PRESERVE_CLIENT_UA")
+
+// By default a client-sent User-Agent replaces the proxy's, as it always
+// has. Configuring UPSTREAM_USER_AGENT pins it unless PRESERVE_CLIENT_UA.
+var forceUserAgent = getEnv("UPSTREAM_USER_AGENT") != "" && !preserveClientUA
+
+var streamResponses = getEnvBool("STREAM_RESPONSES")
+
+var hostFromHeader = getEnvBool("HOST_FROM_HEADER")
+var targetHostHeader = getEnvString("TARGET_HOST_HEADER", "X-Proxy-Target-Host")
 
 func getEnvInt(key string, fallback int) int {
-	val, err := strconv.Atoi(os.Getenv(key))
+	val, err := strconv.Atoi(getEnv(key))
+	if err != nil {
+		return fallback
+	}
+	return val
+}
+
+func getEnvNonNegativeInt(key string, fallback int) int {
+	raw := getEnv(key)
+	if raw == "" {
+		return fallback
+	}
+	val, err := strconv.Atoi(raw)
+	if err != nil || val < 0 {
+		configInvalid(key, fmt.Errorf("must be a non-negative integer, got %q", raw))
+		return fallback
+	}
+	return val
+}
+
+// getEnvPort reads a TCP port number. It is only required when listening
+// on TCP, not on LISTEN_SOCKET.
+func getEnvPort(key string, fallback string) string {
+	raw := getEnv(key)
+	if listenSocket != "" {
+		return raw
+	}
+	if raw == "" {
+		configInvalid(key, errors.New("not set"))
+		return fallback
+	}
+	if n, err := strconv.Atoi(raw); err != nil || n < 1 || n > 65535 {
+		configInvalid(key, fmt.Errorf("invalid port %q", raw))
+		return fallback
+	}
+	return raw
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	val, err := strconv.ParseFloat(getEnv(key), 64)
 	if err != nil {
 		return fallback
 	}
 	return val
 }
 
+func getEnvString(key string, fallback string) string {
+	if val := getEnv(key); val != "" {
+		return val
+	}
+	return fallback
+}
+
+// getEnvList splits a comma-separated env var into its trimmed, non-empty
+// elements.
+func getEnvList(key string, fallback string) []string {
+	return splitList(getEnvString(key, fallback))
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvPositiveInt(key string, fallback int) int {
+	if val := getEnvInt(key, fallback); val > 0 {
+		return val
+	}
+	return fallback
+}
+
+// configErrors collects invalid settings found while parsing the
+// environment so they can all be reported before the proxy starts.
+var configErrors []error
+
+func configError(key string, err error) {
+	configErrors = append(configErrors, fmt.Errorf("%s: %w", key, err))
+}
+
+var strictConfig = getEnvBool("STRICT_CONFIG")
+
+// configWarnings collects settings replaced by their default because
+// STRICT_CONFIG is off, for main to log once logging is set up.
+var configWarnings []string
+
+// configInvalid reports a setting that can fall back to a default: fatal
+// with STRICT_CONFIG, otherwise a warning.
+func configInvalid(key string, err error) {
+	if strictConfig {
+		configError(key, err)
+		return
+	}
+	msg := fmt.Sprintf("%s: %s, using the default", key, err)
+	if conf() == nil {
+		configWarnings = append(configWarnings, msg)
+		return
+	}
+	jlog(map[string]any{"at": "config_warning", "level": "warn", "msg": msg})
+}
+
 var client *fasthttp.Client
 
 func main() {
+	checkConfigFileKeys()
+	if validateOnly {
+		validateAndExit()
+	}
+	if len(configErrors) > 0 {
+		for _, err := range configErrors {
+			log.Printf("Invalid configuration: %s", err)
+		}
+		log.Fatalf("Refusing to start with %d configuration error(s)", len(configErrors))
+	}
+
 	h := func(ctx *fasthttp.RequestCtx) {
 		start := time.Now()
+		inFlight.Add(1)
 		requestHandler(ctx)
+		inFlight.Add(-1)
 
 		status := ctx.Response.StatusCode()
-		durMs := time.Since(start).Milliseconds()
+		dur := time.Since(start)
+		durMs := dur.Milliseconds()
+		observeRequest(status, dur)
 
-		if logErrorsOnly && status < 400 && durMs < int64(logSlowMs) {
+		c := conf()
+		if logFormat == "none" {
+			return
+		}
+		if c.LogErrorsOnly && status < 400 && durMs < int64(c.LogSlowMs) {
 			return // skip normal fast 2xx / 3xx responses
 		}
-		if durMs < int64(logSlowMs) && status < 400 {
+		if durMs < int64(c.LogSlowMs) && status < 400 {
 			return
 		}
 
-		jlog(map[string]any{
+		fields := map[string]any{
 			"at":       "request_end",
+			"level":    statusLevel(status),
 			"method":   string(ctx.Method()),
 			"uri":      string(ctx.RequestURI()),
 			"status":   status,
 			"duration": durMs,
-			"remote":   ctx.RemoteIP().String(),
-		})
+			"remote":   clientIP(ctx).String(),
+		}
+		if n, ok := ctx.UserValue("max_attempts").(int); ok {
+			fields["max_attempts"] = n
+		}
+		for _, k := range []string{"upstream_host", "upstream_path", "attempts", "cache"} {
+			if v := ctx.UserValue(k); v != nil {
+				fields[k] = v
+			}
+		}
+		if c.LogBodies {
+			addBodies(ctx, fields)
+		}
+		rlog(ctx, fields)
 	}
 
+	dial := countConns(newDialer())
 	client = &fasthttp.Client{
 		ReadTimeout:         time.Duration(timeout) * time.Second,
-		MaxIdleConnDuration: 60 * time.Second,
-		MaxConnsPerHost:     16,
+		WriteTimeout:        time.Duration(writeTimeout) * time.Second,
+		MaxIdleConnDuration: time.Duration(maxIdleConnDurationSec) * time.Second,
+		MaxConnsPerHost:     maxConnsPerHost,
+		StreamResponseBody:  streamResponses,
+		Dial:                dial,
+		TLSConfig:           upstreamTLSConfig,
+		MaxResponseBodySize: maxResponseBytes,
+	}
+	if upstreamHTTP2 {
+		h2Client = newH2Client(dial)
 	}
 
-	jlog(map[string]any{
-		"at":      "startup",
-		"port":    port,
-		"timeout": timeout,
-		"retries": retries,
-	})
+	if rateLimitRPS > 0 {
+		ipLimiter = newKeyedLimiter(rateLimitRPS, rateLimitBurst)
+	}
+	if upstreamRPS > 0 {
+		startUpstreamLimiter()
+	}
+	if maxConcurrent > 0 {
+		startConcurrencyLimiter()
+	}
+	if keyQuota > 0 {
+		startQuotaEviction()
+	}
+	if idempotencyTTLSec > 0 {
+		startIdempotencyEviction()
+	}
+	if statsIntervalSec > 0 {
+		startStatsHeartbeat()
+	}
+	if dnsCacheTTLSec > 0 {
+		startDNSCache()
+	}
+	if otelEnabled() {
+		startOTLPExporter()
+	}
+
+	writeLog(startupSummary())
+	for _, msg := range configWarnings {
+		jlog(map[string]any{"at": "startup_warning", "level": "warn", "msg": msg})
+	}
+	jlog(map[string]any{"at": "config_validated", "level": "info", "strict": strictConfig, "warnings": len(configWarnings)})
+	if forwardClientIP && len(trustedProxies) == 0 {
+		jlog(map[string]any{"at": "startup_warning", "level": "warn", "msg": "FORWARD_CLIENT_IP is on, incoming X-Forwarded-For is extended as-is and is only trustworthy behind a proxy that overwrites it"})
+	}
+	if tlsInsecureSkipVerify {
+		jlog(map[string]any{"at": "startup_warning", "level": "warn", "msg": "TLS_INSECURE_SKIP_VERIFY is on, upstream certificates are NOT verified; never use this in production"})
+	}
+	if len(allowedHosts) == 0 {
+		jlog(map[string]any{"at": "startup_warning", "level": "warn", "msg": "ALLOWED_HOSTS is unset, any upstream host will be proxied"})
+	}
+
+	if tlsEnabled() {
+		if err := loadCertificate(); err != nil {
+			log.Fatalf("Error loading TLS certificate: %s", err)
+		}
+	}
+	go handleSIGHUP()
+	go handleSIGUSR1()
 
-	if err := fasthttp.ListenAndServe(":"+port, h); err != nil {
-		log.Fatalf("Error in ListenAndServe: %s", err)
+	server := &fasthttp.Server{
+		Handler:            withLocalCompression(h),
+		ErrorHandler:       serverError,
+		MaxRequestBodySize: maxRequestBytes,
+		DisableKeepalive:   disableKeepalive,
+		MaxRequestsPerConn: maxRequestsPerConn,
+		IdleTimeout:        time.Duration(idleTimeoutSec) * time.Second,
+		MaxConnsPerIP:      maxConnsPerIP,
+		ReadTimeout:        time.Duration(clientReadTimeoutSec) * time.Second,
+	}
+	if clientBodyTimeoutSec > 0 {
+		server.HeaderReceived = bodyReadDeadline
+	}
+	if expectContinue {
+		server.ContinueHandler = continuePreflight
+	}
+	proxyServer = server
+	go func() {
+		if err := serve(server); err != nil {
+			log.Fatalf("Error in ListenAndServe: %s", err)
+		}
+	}()
+	servers := []*fasthttp.Server{server}
+	if adminPort != "" {
+		servers = append(servers, startAdminServer())
 	}
+	awaitShutdown(servers...)
 }
 
-func jlog(fields map[string]any) {
-	b, _ := json.Marshal(fields)
-	log.Println(string(b))
+// startupSummary describes the effective configuration, logged at startup
+// and printed by VALIDATE_ONLY.
+func startupSummary() map[string]any {
+	return map[string]any{
+		"at":                          "startup",
+		"level":                       "info",
+		"config_file":                 configFile,
+		"config":                      redactedFileSettings(),
+		"port":                        port,
+		"strict_config":               strictConfig,
+		"routing":                     routingMode(),
+		"strip_response_cookies":      stripResponseCookies,
+		"strip_response_headers":      stripResponseHeaders,
+		"add_response_headers":        len(addResponseHeaders),
+		"allowed_methods":             allowedMethodList,
+		"enable_debug_vars":           enableDebugVars,
+		"idempotency_ttl_sec":         idempotencyTTLSec,
+		"idempotency_max_entries":     idempotencyMaxEntries,
+		"coalesce_gets":               coalesceGets,
+		"stats_interval_sec":          statsIntervalSec,
+		"max_retry_after_sec":         maxRetryAfterSec,
+		"retry_after_over_cap":        retryAfterOverCap,
+		"retry_429":                   retry429,
+		"retry_503_after":             retry503After,
+		"prefork":                     preforkEnabled,
+		"worker":                      workerName(),
+		"ca_bundle_file":              caBundleFile,
+		"tls_insecure_skip_verify":    tlsInsecureSkipVerify,
+		"client_ca_file":              clientCAFile,
+		"require_client_cert":         requireClientCert,
+		"mtls_or_key":                 mtlsOrKey,
+		"proxy_protocol":              proxyProtocol,
+		"trusted_proxies":             len(trustedProxies),
+		"via_name":                    viaName,
+		"disable_via":                 disableVia,
+		"upstream_status_header":      upstreamStatusHeader,
+		"disable_upstream_status":     disableUpstreamStatus,
+		"admin_port":                  adminPort,
+		"listener":                    listenerType(),
+		"listen_socket":               listenSocket,
+		"listen_addr":                 bindAddr(port),
+		"timeout":                     timeout,
+		"retries":                     conf().Retries,
+		"write_timeout":               writeTimeout,
+		"dial_timeout":                dialTimeout,
+		"dns_cache_ttl_sec":           dnsCacheTTLSec,
+		"dns_stale_sec":               dnsStaleSec,
+		"hedge_after_ms":              hedgeAfterMs,
+		"negotiate_encoding":          negotiateEncoding,
+		"cors_allow_origin":           corsAllowOrigins,
+		"egress_proxy":                egressProxyRedacted(),
+		"egress_ips":                  egressIPs,
+		"max_conns_per_host":          maxConnsPerHost,
+		"max_idle_conn_duration_sec":  maxIdleConnDurationSec,
+		"rate_limit_rps":              rateLimitRPS,
+		"rate_limit_burst":            rateLimitBurst,
+		"upstream_rps":                upstreamRPS,
+		"upstream_burst":              upstreamBurst,
+		"upstream_max_wait_ms":        upstreamMaxWaitMs,
+		"max_concurrent":              maxConcurrent,
+		"cb_failure_threshold":        cbFailureThreshold,
+		"cb_reset_sec":                cbResetSec,
+		"cache_ttl_sec":               cacheTTLSec,
+		"cache_ttl_rules":             len(cacheTTLRules),
+		"cache_swr_sec":               cacheSWRSec,
+		"serve_stale_on_error":        serveStaleOnError,
+		"cache_stale_max_sec":         cacheStaleMaxSec,
+		"batch_max_requests":          batchMaxRequests,
+		"batch_concurrency":           batchConcurrency,
+		"max_total_conns":             maxTotalConns,
+		"max_total_conns_mode":        maxTotalConnsMode,
+		"cache_max_entries":           cacheMaxEntries,
+		"backoff_base_ms":             backoffBaseMs,
+		"backoff_factor":              backoffFactor,
+		"backoff_max_ms":              backoffMaxMs,
+		"err_backoff_ms":              errBackoff.baseMs,
+		"err_backoff_max_ms":          errBackoff.maxMs,
+		"status_backoff_ms":           statusBackoff.baseMs,
+		"status_backoff_max_ms":       statusBackoff.maxMs,
+		"stream_responses":            streamResponses,
+		"shutdown_grace_sec":          shutdownGraceSec,
+		"attempt_timeout_ms":          attemptTimeoutMs,
+		"total_deadline_ms":           totalDeadlineMs,
+		"client_timeout_min_ms":       clientTimeoutMinMs,
+		"client_timeout_max_ms":       clientTimeoutMaxMs,
+		"max_client_retries":          maxClientRetries,
+		"max_response_bytes":          maxResponseBytes,
+		"max_request_bytes":           maxRequestBytes,
+		"allowed_hosts":               allowedHosts,
+		"error_format_json":           errorFormatJSON,
+		"sleep_on_429":                sleepOn429,
+		"header_validation":           headerValidation,
+		"forward_client_ip":           forwardClientIP,
+		"auto_csrf":                   autoCSRF,
+		"user_agent":                  userAgent,
+		"preserve_client_ua":          preserveClientUA,
+		"generate_trace":              generateTrace,
+		"log_bodies":                  conf().LogBodies,
+		"log_format":                  logFormat,
+		"debug_headers":               debugHeaders,
+		"rewrite_rules":               len(rewriteRules),
+		"blocked_paths":               len(blockedPaths),
+		"retry_budget_rate":           retryBudgetRate,
+		"retry_budget_ratio":          retryBudgetRatio,
+		"retry_budget_burst":          retryBudgetBurst,
+		"retry_safe_rules":            len(retrySafeRules),
+		"cache_warm_max_urls":         cacheWarmMaxURLs,
+		"retry_body_patterns":         len(retryBodyPatterns),
+		"retry_body_max_bytes":        retryBodyMaxBytes,
+		"failover_hosts":              len(failoverHosts),
+		"drain_delay_sec":             drainDelaySec,
+		"maintenance_mode":            maintenance.Load(),
+		"maintenance_status":          maintenanceStatus,
+		"maintenance_body":            maintenanceBody != "",
+		"maintenance_retry_after_sec": maintenanceRetryAfterSec,
+		"upstream_http2":              upstreamHTTP2,
+		"disable_keepalive":           disableKeepalive,
+		"max_requests_per_conn":       maxRequestsPerConn,
+		"idle_timeout_sec":            idleTimeoutSec,
+		"max_conns_per_ip":            maxConnsPerIP,
+		"client_read_timeout_sec":     clientReadTimeoutSec,
+		"client_body_timeout_sec":     clientBodyTimeoutSec,
+		"field_projection":            fieldProjection,
+		"compress_local":              compressLocal,
+		"compress_local_min_bytes":    compressLocalMinBytes,
+		"expect_continue":             expectContinue,
+		"otel_endpoint":               otelEndpoint != "",
+		"otel_service_name":           otelServiceName,
+		"enable_pprof":                enablePprof,
+		"proxy_keys":                  len(conf().ProxyKeys),
+		"key_quota":                   keyQuota,
+		"key_quota_window_sec":        keyQuotaWindowSec,
+		"roblox_cookie":               robloxCookie != "",
+		"roblox_cookie_hosts":         robloxCookieHosts,
+	}
 }
 
 func init() {
@@ -80,60 +435,348 @@ func init() {
 }
 
 func requestHandler(ctx *fasthttp.RequestCtx) {
-	val, ok := os.LookupEnv("KEY")
+	assignRequestID(ctx)
 
-	if ok && string(ctx.Request.Header.Peek("PROXYKEY")) != val {
-		ctx.SetStatusCode(407)
-		ctx.SetBody([]byte("Missing or invalid PROXYKEY header."))
+	if adminPort == "" && adminHandler(ctx) {
 		return
 	}
 
-	if len(strings.SplitN(string(ctx.Request.Header.RequestURI())[1:], "/", 2)) < 2 {
-		ctx.SetStatusCode(400)
-		ctx.SetBody([]byte("URL format invalid."))
+	if refuseDraining(ctx) {
 		return
 	}
 
-	response := makeRequest(ctx, 1)
-	defer fasthttp.ReleaseResponse(response)
+	if smugglingBlocked(ctx) {
+		return
+	}
+
+	startTrace(ctx)
+	startRequestSpan(ctx)
+	defer endRequestSpan(ctx)
+	defer applyCORS(ctx)
+
+	if corsPreflight(ctx) {
+		return
+	}
+
+	if refuseMaintenance(ctx) {
+		return
+	}
+
+	if batchHandler(ctx) {
+		return
+	}
+
+	if !acquireSlot(ctx) {
+		return
+	}
+	defer releaseSlot()
+
+	if !authorize(ctx) {
+		setError(&ctx.Response, 407, "proxy_auth_required", authFailureMessage)
+		return
+	}
+
+	if methodNotAllowed(ctx) {
+		return
+	}
+
+	upHost, upPath, ok := target(ctx)
+	if !ok {
+		if hostFromHeader {
+			setError(&ctx.Response, 400, "invalid_target_host", "Missing or invalid "+targetHostHeader+" header.")
+		} else {
+			setError(&ctx.Response, 400, "invalid_url", "URL format invalid.")
+		}
+		return
+	}
+
+	ctx.SetUserValue("upstream_host", upHost)
+	ctx.SetUserValue("upstream_path", "/"+upPath)
+
+	if !hostAllowed(upHost) {
+		setError(&ctx.Response, 403, "host_not_allowed", "Host not allowed")
+		return
+	}
+
+	if requestTooLarge(ctx) {
+		return
+	}
+
+	if rateLimitIP(ctx) {
+		return
+	}
+
+	if enforceQuota(ctx) {
+		return
+	}
 
+	cacheKey, cacheState := "", ""
+	var response *fasthttp.Response
+	if cacheable(ctx) {
+		cacheKey = "https://" + upHost + "/" + upPath
+		mode := cacheRequestMode(ctx)
+		if mode == "bypass" {
+			cacheState = "BYPASS"
+		} else if cached, stale := cacheGet(cacheKey); cached != nil {
+			response, cacheState = cached, "HIT"
+			if stale {
+				cacheState = "STALE"
+				revalidate(ctx, cacheKey)
+			}
+		} else if mode == "only-if-cached" {
+			setError(&ctx.Response, 504, "not_cached", "Not in cache.")
+			ctx.Response.Header.Set("X-Cache", "MISS")
+			ctx.SetUserValue("cache", "MISS")
+			return
+		} else {
+			cacheState = "MISS"
+		}
+	}
+	if response == nil {
+		response = idempotentRequest(ctx, upHost, upPath)
+		if cacheState != "" && ctx.IsGet() {
+			cacheStore(cacheKey, response)
+		}
+		if cacheState == "MISS" && ctx.IsGet() {
+			var stale bool
+			if response, stale = staleOnError(ctx, cacheKey, response); stale {
+				cacheState = "STALE-ERROR"
+			}
+		}
+	}
+
+	if negotiateEncoding {
+		decodeForClient(ctx, response)
+	}
+	projectFields(ctx, response)
+
+	ctx.SetUserValue("upstream_response", true)
 	ctx.SetStatusCode(response.StatusCode())
 	response.Header.VisitAll(func(key, value []byte) {
+		if strippedResponseHeader(key) {
+			return
+		}
 		ctx.Response.Header.Set(string(key), string(value))
 	})
+	for _, h := range addResponseHeaders {
+		ctx.Response.Header.Set(h.name, h.value)
+	}
+
+	// X-Proxy-Upstream-Status (or UPSTREAM_STATUS_HEADER) is always the
+	// status the upstream returned. X-Proxy-RateLimited additionally marks
+	// an upstream 429, whose Retry-After and x-ratelimit-* headers were
+	// copied through verbatim above, as opposed to a 429 generated by the
+	// proxy's own limiters.
+	if !disableUpstreamStatus {
+		ctx.Response.Header.Set(upstreamStatusHeader, strconv.Itoa(response.StatusCode()))
+	}
+	if response.StatusCode() == 429 {
+		ctx.Response.Header.Set("X-Proxy-RateLimited", "true")
+	}
+	appendVia(ctx)
+	setDebugHeaders(ctx)
+	if cacheState != "" {
+		ctx.Response.Header.Set("X-Cache", cacheState)
+		ctx.SetUserValue("cache", cacheState)
+	}
 
-	ctx.Response.Header.Set("X-Proxy-Upstream-Status", strconv.Itoa(response.StatusCode()))
-	ctx.Response.Header.Set("Via", "roproxy-lite")
+	if ctx.IsHead() {
+		// HEAD never carries a body, whatever the upstream sent, but keeps
+		// the length a GET would have had, including a cached GET's.
+		length := response.Header.ContentLength()
+		if body := response.Body(); len(body) > 0 {
+			length = len(body)
+		}
+		ctx.Response.SkipBody = true
+		ctx.Response.Header.SetContentLength(length)
+		fasthttp.ReleaseResponse(response)
+		return
+	}
 
+	if stream := response.BodyStream(); stream != nil {
+		// fasthttp closes the stream once it has been copied to the client,
+		// which is when the upstream response can be released.
+		ctx.SetBodyStream(&releasingReader{stream, response}, response.Header.ContentLength())
+		return
+	}
 	ctx.SetBody(response.Body())
+	fasthttp.ReleaseResponse(response)
 }
 
-func makeRequest(ctx *fasthttp.RequestCtx, attempt int) *fasthttp.Response {
-	if attempt > retries {
-		r := fasthttp.AcquireResponse()
-		r.SetStatusCode(504)
-		r.SetBodyString("upstream timeout")
-		return r
-	}
+type releasingReader struct {
+	io.Reader
+	resp *fasthttp.Response
+}
 
-	raw := string(ctx.RequestURI())
+func (r *releasingReader) Close() error {
+	fasthttp.ReleaseResponse(r.resp)
+	return nil
+}
+
+// splitTarget splits a request URI of the form /host/path into the upstream
+// host and path.
+func splitTarget(raw string) (string, string, bool) {
 	parts := strings.SplitN(raw[1:], "/", 2)
 	if len(parts) < 2 {
-		r := fasthttp.AcquireResponse()
-		r.SetStatusCode(400)
-		r.SetBodyString("URL format invalid.")
+		return "", "", false
+	}
+	return parts[0], strings.TrimPrefix(parts[1], "/"), true
+}
+
+func routingMode() string {
+	if hostFromHeader {
+		return "header " + targetHostHeader + ", path forwarded as-is"
+	}
+	return "path prefix /host/path"
+}
+
+// upstreamPath returns path, given without its leading slash, as fasthttp
+// sends it upstream: percent-decoded, with dot segments and repeated slashes
+// collapsed and without the query string.
+func upstreamPath(path string) string {
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+	u.Parse(nil, []byte("/"+path))
+	return string(u.Path())
+}
+
+// target returns the upstream host and path for the request: from the
+// first path segment by default, or with HOST_FROM_HEADER from the
+// TARGET_HOST_HEADER header, forwarding the whole path unchanged.
+func target(ctx *fasthttp.RequestCtx) (string, string, bool) {
+	raw := string(ctx.RequestURI())
+	if !hostFromHeader {
+		return splitTarget(raw)
+	}
+	host := strings.ToLower(string(ctx.Request.Header.Peek(targetHostHeader)))
+	if !validHost(host) {
+		return "", "", false
+	}
+	return host, strings.TrimPrefix(raw, "/"), true
+}
+
+// attemptState carries a request's retry progress across makeRequest calls.
+type attemptState struct {
+	attempt     int
+	deadline    time.Time     // zero when neither TOTAL_DEADLINE_MS nor X-Proxy-Timeout-Ms applies
+	timeout     time.Duration // per-attempt bound from X-Proxy-Timeout-Ms, or ATTEMPT_TIMEOUT_MS
+	maxAttempts int           // RETRIES, or one more than X-Proxy-Retries
+	lastErr     error         // the most recent client.Do error, if any
+	host        string        // the upstream host being tried, once chosen
+	hosts       []string      // FAILOVER_HOSTS alternates not yet tried
+}
+
+func newAttemptState(ctx *fasthttp.RequestCtx) *attemptState {
+	st := &attemptState{attempt: 1, maxAttempts: conf().Retries, timeout: time.Duration(attemptTimeoutMs) * time.Millisecond}
+	if n, ok := clientRetries(ctx); ok {
+		st.maxAttempts = n + 1
+	}
+	ctx.SetUserValue("max_attempts", st.maxAttempts)
+	retryBudgetDeposit()
+	if totalDeadlineMs > 0 {
+		st.deadline = time.Now().Add(time.Duration(totalDeadlineMs) * time.Millisecond)
+	}
+	if t, ok := clientTimeout(ctx); ok {
+		st.timeout = t
+		if d := time.Now().Add(t); st.deadline.IsZero() || d.Before(st.deadline) {
+			st.deadline = d
+		}
+	}
+	return st
+}
+
+// attemptTimeout bounds the next attempt, end to end, by the per-attempt
+// timeout or whatever is left of the deadline, whichever is sooner. Zero
+// means unbounded.
+func (st *attemptState) attemptTimeout() time.Duration {
+	if st.deadline.IsZero() {
+		return st.timeout
+	}
+	left := time.Until(st.deadline)
+	if st.timeout > 0 {
+		return min(st.timeout, left)
+	}
+	return left
+}
+
+// clientRetries reads X-Proxy-Retries, the number of retries the client
+// wants after the first attempt, capped at MAX_CLIENT_RETRIES. 0 returns
+// whatever the first attempt got.
+func clientRetries(ctx *fasthttp.RequestCtx) (int, bool) {
+	raw := ctx.Request.Header.Peek("X-Proxy-Retries")
+	if len(raw) == 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(raw))
+	if err != nil || n < 0 {
+		rlog(ctx, map[string]any{"at": "retries_header_ignored", "level": "warn", "value": string(raw)})
+		return 0, false
+	}
+	return min(n, maxClientRetries), true
+}
+
+// clientTimeout reads X-Proxy-Timeout-Ms, which bounds both each upstream
+// attempt and the whole retry window. Values that aren't a number between
+// CLIENT_TIMEOUT_MIN_MS and CLIENT_TIMEOUT_MAX_MS are ignored.
+func clientTimeout(ctx *fasthttp.RequestCtx) (time.Duration, bool) {
+	raw := ctx.Request.Header.Peek("X-Proxy-Timeout-Ms")
+	if len(raw) == 0 {
+		return 0, false
+	}
+	ms, err := strconv.Atoi(string(raw))
+	if err != nil || ms < clientTimeoutMinMs || ms > clientTimeoutMaxMs {
+		rlog(ctx, map[string]any{"at": "timeout_header_ignored", "level": "warn", "value": string(raw), "min_ms": clientTimeoutMinMs, "max_ms": clientTimeoutMaxMs})
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+func makeRequest(ctx *fasthttp.RequestCtx, st *attemptState) *fasthttp.Response {
+	attempt := st.attempt
+	if !st.deadline.IsZero() && time.Now().After(st.deadline) {
+		rlog(ctx, map[string]any{"at": "deadline_exceeded", "level": "warn", "attempts": attempt - 1, "uri": string(ctx.RequestURI())})
+		r := errorResponse(504, "deadline_exceeded", "total request deadline exceeded")
+		r.Header.Set("X-Deadline-Exceeded", "true")
 		return r
 	}
-	upHost, upPath := parts[0], parts[1]
-	upPath = strings.TrimPrefix(upPath, "/")
+	if attempt > st.maxAttempts {
+		return exhaustedResponse(st.lastErr)
+	}
+	ctx.SetUserValue("attempts", attempt)
+
+	raw := string(ctx.RequestURI())
+	if attempt > 1 && clientGone(ctx) {
+		rlog(ctx, map[string]any{"at": "client_gone", "level": "debug", "attempt": attempt, "uri": raw})
+		return errorResponse(499, "client_closed", "client closed request")
+	}
+
+	upHost, upPath, ok := target(ctx)
+	if !ok {
+		return errorResponse(400, "invalid_url", "URL format invalid.")
+	}
+
+	if st.host == "" {
+		order := failoverOrder(upHost)
+		st.host, st.hosts = order[0], order[1:]
+		if st.host != upHost {
+			ctx.SetUserValue("upstream_host", st.host)
+		}
+	}
+	upHost = st.host
+
+	upPath = rewritePath(ctx, upHost, upPath)
 
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
 	req.Header.SetMethodBytes(ctx.Method())
 	req.SetRequestURI("https://" + upHost + "/" + upPath)
+	if r := pathBlocked(ctx, req, upHost); r != nil {
+		return r
+	}
+	retryVerdict(ctx, upHost, string(req.URI().Path()))
 	req.Header.SetHost(upHost)
-	req.Header.Set("User-Agent", "RoProxy")
+	req.Header.Set("User-Agent", userAgent)
 	req.Header.Del("Roblox-Id")
 	req.SetBody(ctx.Request.Body())
 
@@ -141,35 +784,217 @@ func makeRequest(ctx *fasthttp.RequestCtx, attempt int) *fasthttp.Response {
 		switch strings.ToLower(string(k)) {
 		case "host", "connection", "proxy-connection", "keep-alive",
 			"transfer-encoding", "upgrade", "te", "content-length",
-			"accept-encoding", "proxykey", "x-request-id":
+			"accept-encoding", "expect", "proxykey", "x-request-id",
+			"x-forwarded-for", "x-real-ip", "x-proxy-timeout-ms",
+			"x-proxy-retries", "x-proxy-cache-bypass", "x-proxy-fields":
 			return
 		default:
+			if hostFromHeader && strings.EqualFold(string(k), targetHostHeader) {
+				return
+			}
 			req.Header.SetBytesKV(k, v)
 		}
 	})
 
-	resp := fasthttp.AcquireResponse()
-	if err := client.Do(req, resp); err != nil {
-		jlog(map[string]any{"at": "retry_err", "attempt": attempt, "uri": raw, "err": err.Error()})
+	if negotiateEncoding {
+		if ae := ctx.Request.Header.Peek("Accept-Encoding"); len(ae) > 0 {
+			req.Header.SetBytesV("Accept-Encoding", ae)
+		}
+	}
+
+	applyRobloxCookie(req, upHost)
+
+	if forceUserAgent {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	if forwardClientIP {
+		peer := ctx.RemoteIP().String()
+		if prior := priorForwardedFor(ctx); len(prior) > 0 {
+			req.Header.Set("X-Forwarded-For", string(prior)+", "+peer)
+		} else {
+			req.Header.Set("X-Forwarded-For", peer)
+		}
+		req.Header.Set("X-Real-IP", clientIP(ctx).String())
+	}
+
+	if !breakerAllow(upHost) {
+		if st.failover(ctx, "circuit_open") {
+			return makeRequest(ctx, st)
+		}
+		r := errorResponse(503, "circuit_open", "upstream circuit open")
+		r.Header.Set("X-Circuit-Open", "true")
+		return r
+	}
+
+	// With STREAM_RESPONSES, Do returns once the upstream headers are read,
+	// so only failures up to that point can be retried; a body that fails
+	// mid-stream can't be replayed to the client.
+	waitStart := time.Now()
+	if !awaitUpstreamToken() {
+		breakerRelease(upHost)
+		return errorResponse(503, "upstream_busy", "upstream rate limit exceeded")
+	}
+	phases(ctx).wait += time.Since(waitStart)
+
+	applyCSRFToken(req, upHost)
+
+	upStart := time.Now()
+	span := startAttemptSpan(ctx, req, upHost, attempt)
+	attemptTimeout := st.attemptTimeout()
+	resp, err := doUpstream(ctx, req, upHost, attemptTimeout)
+	endAttemptSpan(span, resp, err)
+	upDur := time.Since(upStart)
+	phases(ctx).upstream += upDur
+	observeHost(upHost, upDur, err != nil || resp.StatusCode() >= 500)
+	if err != nil {
+		if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+			breakerRecord(upHost, false)
+			fasthttp.ReleaseResponse(resp)
+			rlog(ctx, map[string]any{"at": "response_too_large", "level": "warn", "limit": maxResponseBytes, "uri": raw})
+			return errorResponse(502, "response_too_large", "upstream response too large")
+		}
+		if errors.Is(err, errConnLimit) {
+			breakerRelease(upHost)
+			fasthttp.ReleaseResponse(resp)
+			rlog(ctx, map[string]any{"at": "conn_limit", "level": "warn", "limit": maxTotalConns, "mode": maxTotalConnsMode, "uri": raw})
+			r := errorResponse(503, "too_many_connections", "too many upstream connections")
+			r.Header.Set("Retry-After", "1")
+			return r
+		}
+		breakerRecord(upHost, true)
+		recordHostHealth(upHost, true)
 		fasthttp.ReleaseResponse(resp)
-		time.Sleep(time.Duration(100*attempt) * time.Millisecond)
-		return makeRequest(ctx, attempt+1)
+		if isTimeout(err) {
+			rlog(ctx, map[string]any{"at": "attempt_timeout", "level": "info", "attempt": attempt, "timeout_ms": attemptTimeout.Milliseconds(), "uri": raw})
+		}
+		class := errorClass(err)
+		if class == "permanent" {
+			rlog(ctx, map[string]any{"at": "retry_skipped", "level": "debug", "reason": "permanent", "attempt": attempt, "uri": raw, "err": err.Error()})
+			return upstreamErrorResponse(class)
+		}
+		if !retryableMethod(ctx) && !isDialError(err) {
+			rlog(ctx, map[string]any{"at": "retry_skipped", "level": "debug", "reason": "method", "method": string(ctx.Method()), "attempt": attempt, "uri": raw, "err": err.Error()})
+			return upstreamErrorResponse(class)
+		}
+		if attempt >= st.maxAttempts {
+			if st.failover(ctx, "retries_exhausted") {
+				return makeRequest(ctx, st)
+			}
+			return exhaustedResponse(err) // no point sleeping before giving up
+		}
+		if !retryBudgetAllow(ctx, "retry_err", attempt) {
+			return upstreamErrorResponse(class)
+		}
+		sleep := backoff(errBackoff, attempt)
+		rlog(ctx, map[string]any{"at": "retry_err", "level": "debug", "backoff": errBackoff.name, "attempt": attempt, "uri": raw, "err": err.Error(), "error_class": class, "sleep_ms": sleep.Milliseconds()})
+		observeRetry("retry_err")
+		if r := retrySleep(ctx, sleep); r != nil {
+			return r
+		}
+		st.lastErr = err
+		st.attempt++
+		return makeRequest(ctx, st)
+	}
+
+	if len(egressIPs) > 0 {
+		if laddr, ok := resp.LocalAddr().(*net.TCPAddr); ok {
+			ctx.SetUserValue("source_ip", laddr.IP.String())
+		}
 	}
 
 	sc := resp.StatusCode()
+	breakerRecord(upHost, sc >= 500 && sc <= 599)
+	recordHostHealth(upHost, sc >= 500 && sc <= 599)
 	if sc == 429 {
-		if ra := resp.Header.Peek("Retry-After"); len(ra) > 0 {
-			if s, _ := strconv.Atoi(string(ra)); s > 0 {
-				time.Sleep(time.Duration(s)*time.Second + 100*time.Millisecond)
+		sleep, ok := retryAfterSleep(ctx, resp)
+		// With RETRY_429 the wait counts against RETRIES like any other
+		// retry, and the last attempt's 429 is passed through rather than
+		// turning into a 504.
+		if retry429 && ok && retryableMethod(ctx) && attempt < st.maxAttempts && retryBudgetAllow(ctx, "retry_429", attempt) {
+			policy := "retry_after"
+			if sleep == 0 {
+				sleep, policy = backoff(statusBackoff, attempt), statusBackoff.name
+			}
+			rlog(ctx, map[string]any{"at": "retry_429", "level": "debug", "backoff": policy, "attempt": attempt, "uri": raw, "sleep_ms": sleep.Milliseconds()})
+			if r := retrySleep(ctx, sleep); r != nil {
+				fasthttp.ReleaseResponse(resp)
+				return r
 			}
+			observeRetry("retry_429")
+			resp.Reset()
+			st.attempt++
+			return makeRequest(ctx, st)
+		}
+		if sleepOn429 && sleep > 0 {
+			retrySleep(ctx, sleep) // cut short or not, the 429 is the answer
 		}
 		return resp
 	}
-	if sc >= 500 && sc <= 599 {
-		jlog(map[string]any{"at": "retry_5xx", "attempt": attempt, "status": sc, "uri": raw})
-		time.Sleep(time.Duration(100*attempt) * time.Millisecond)
+	if retryStatuses[sc] {
+		if attempt >= st.maxAttempts {
+			if st.failover(ctx, "retries_exhausted") {
+				fasthttp.ReleaseResponse(resp)
+				return makeRequest(ctx, st)
+			}
+			return resp // the final attempt's 5xx passes through as-is
+		}
+		if !retryableMethod(ctx) {
+			rlog(ctx, map[string]any{"at": "retry_skipped", "level": "debug", "reason": "method", "method": string(ctx.Method()), "attempt": attempt, "status": sc, "uri": raw})
+			return resp
+		}
+		// A 503 with Retry-After is a planned outage, so its delay is
+		// honoured, capped as for 429s, instead of the usual backoff.
+		if sc == 503 && retry503After {
+			sleep, ok := retryAfterSleep(ctx, resp)
+			if !ok {
+				return resp
+			}
+			if sleep > 0 {
+				if !retryBudgetAllow(ctx, "retry_503", attempt) {
+					return resp
+				}
+				rlog(ctx, map[string]any{"at": "retry_503", "level": "debug", "attempt": attempt, "uri": raw, "sleep_ms": sleep.Milliseconds()})
+				observeRetry("retry_503")
+				if r := retrySleep(ctx, sleep); r != nil {
+					fasthttp.ReleaseResponse(resp)
+					return r
+				}
+				resp.Reset()
+				st.lastErr = nil
+				st.attempt++
+				return makeRequest(ctx, st)
+			}
+		}
+		if !retryBudgetAllow(ctx, "retry_5xx", attempt) {
+			return resp
+		}
+		sleep := backoff(statusBackoff, attempt)
+		rlog(ctx, map[string]any{"at": "retry_5xx", "level": "debug", "backoff": statusBackoff.name, "attempt": attempt, "status": sc, "uri": raw, "sleep_ms": sleep.Milliseconds()})
+		observeRetry("retry_5xx")
+		if r := retrySleep(ctx, sleep); r != nil {
+			fasthttp.ReleaseResponse(resp)
+			return r
+		}
 		resp.Reset()
-		return makeRequest(ctx, attempt+1)
+		st.lastErr = nil
+		st.attempt++
+		return makeRequest(ctx, st)
+	}
+	if attempt < st.maxAttempts && retryableMethod(ctx) {
+		if pattern := retryBodyMatch(resp); pattern != "" && retryBudgetAllow(ctx, "retry_body", attempt) {
+			sleep := backoff(statusBackoff, attempt)
+			rlog(ctx, map[string]any{"at": "retry_body", "level": "debug", "backoff": statusBackoff.name, "attempt": attempt, "pattern": pattern, "uri": raw, "sleep_ms": sleep.Milliseconds()})
+			observeRetry("retry_body")
+			if r := retrySleep(ctx, sleep); r != nil {
+				fasthttp.ReleaseResponse(resp)
+				return r
+			}
+			resp.Reset()
+			st.lastErr = nil
+			st.attempt++
+			return makeRequest(ctx, st)
+		}
 	}
 	return resp
 }
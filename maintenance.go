@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var maintenanceStatus = getEnvPositiveInt("MAINTENANCE_STATUS", 503)
+var maintenanceBody = getEnv("MAINTENANCE_BODY")
+var maintenanceRetryAfterSec = getEnvNonNegativeInt("MAINTENANCE_RETRY_AFTER_SEC", 60)
+
+// maintenance short-circuits every proxy request with the canned response.
+// It starts from MAINTENANCE_MODE and is toggled through /admin/maintenance.
+var maintenance atomic.Bool
+var maintenanceHits atomic.Int64
+
+// maintenanceLogEvery samples maintenance_hit records: the first hit is
+// logged and then every this many.
+const maintenanceLogEvery = 100
+
+func init() {
+	maintenance.Store(getEnvBool("MAINTENANCE_MODE"))
+	if maintenanceStatus < 200 || maintenanceStatus > 599 {
+		configError("MAINTENANCE_STATUS", fmt.Errorf("must be an HTTP status from 200 to 599, got %d", maintenanceStatus))
+	}
+}
+
+// refuseMaintenance writes the maintenance response and reports true while
+// maintenance mode is on. MAINTENANCE_BODY, when set, is sent verbatim, as
+// JSON if it parses as such.
+func refuseMaintenance(ctx *fasthttp.RequestCtx) bool {
+	if !maintenance.Load() {
+		return false
+	}
+	if n := maintenanceHits.Add(1); n%maintenanceLogEvery == 1 {
+		rlog(ctx, map[string]any{"at": "maintenance_hit", "hits": n, "uri": string(ctx.RequestURI()), "remote": clientIP(ctx).String()})
+	}
+	if maintenanceBody == "" {
+		setError(&ctx.Response, maintenanceStatus, "maintenance", "Proxy is under maintenance.")
+	} else {
+		ctx.SetStatusCode(maintenanceStatus)
+		ctx.SetContentType("text/plain; charset=utf-8")
+		if json.Valid([]byte(maintenanceBody)) {
+			ctx.SetContentType("application/json")
+		}
+		ctx.SetBodyString(maintenanceBody)
+	}
+	if maintenanceRetryAfterSec > 0 {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(maintenanceRetryAfterSec))
+	}
+	return true
+}
+
+// setMaintenance switches maintenance mode, logging the change.
+func setMaintenance(on bool, source string) {
+	if maintenance.Swap(on) == on {
+		return
+	}
+	at := "maintenance_off"
+	if on {
+		at = "maintenance_on"
+		maintenanceHits.Store(0)
+	}
+	jlog(map[string]any{"at": at, "level": "warn", "source": source})
+}
+
+// maintenanceHandler serves /admin/maintenance: POST turns maintenance mode
+// on, DELETE turns it off and GET reports the state. It reports whether the
+// path matched.
+func maintenanceHandler(ctx *fasthttp.RequestCtx) bool {
+	if string(ctx.Path()) != "/admin/maintenance" {
+		return false
+	}
+	if !adminWriteAuthorized(ctx) {
+		return true
+	}
+	switch {
+	case ctx.IsPost():
+		setMaintenance(true, "admin")
+	case ctx.IsDelete():
+		setMaintenance(false, "admin")
+	case !ctx.IsGet():
+		setError(&ctx.Response, 405, "method_not_allowed", "Method not allowed.")
+		return true
+	}
+	b, _ := json.Marshal(map[string]any{"maintenance": maintenance.Load(), "hits": maintenanceHits.Load()})
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	return true
+}
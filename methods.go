@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+var allowedMethodList = getEnvMethods("ALLOWED_METHODS", "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS")
+var allowedMethods = methodSet(allowedMethodList)
+
+func getEnvMethods(key string, fallback string) []string {
+	methods := getEnvList(key, fallback)
+	for i, m := range methods {
+		if !validHeaderName(m) {
+			configError(key, fmt.Errorf("invalid method %q", m))
+		}
+		methods[i] = strings.ToUpper(m)
+	}
+	return methods
+}
+
+// methodNotAllowed writes a 405 listing ALLOWED_METHODS when the client's
+// method isn't among them. It reports whether the request was rejected.
+func methodNotAllowed(ctx *fasthttp.RequestCtx) bool {
+	if allowedMethods[string(ctx.Method())] {
+		return false
+	}
+	setError(&ctx.Response, 405, "method_not_allowed", "Method not allowed.")
+	ctx.Response.Header.Set("Allow", strings.Join(allowedMethodList, ", "))
+	return true
+}
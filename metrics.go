@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var metricsPath = getEnvString("METRICS_PATH", "/metrics")
+var metricsKey = getEnv("METRICS_KEY")
+var statsIntervalSec = getEnvNonNegativeInt("STATS_INTERVAL_SEC", 60)
+
+// Upper bounds in seconds, clustered around the LOG_SLOW_MS default of 300ms.
+var latencyBuckets = []float64{0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1, 2.5, 5, 10, 30}
+
+var statusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+var retryReasons = []string{"retry_err", "retry_5xx", "retry_429", "retry_body", "retry_503"}
+
+var inFlight atomic.Int64
+
+var metrics struct {
+	requests      atomic.Int64
+	byClass       [5]atomic.Int64
+	retries       [5]atomic.Int64
+	latencyCounts [11]atomic.Int64
+	latencySumUs  atomic.Int64
+}
+
+func observeRequest(status int, dur time.Duration) {
+	metrics.requests.Add(1)
+	if class := status/100 - 1; class >= 0 && class < len(metrics.byClass) {
+		metrics.byClass[class].Add(1)
+	}
+	secs := dur.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			metrics.latencyCounts[i].Add(1)
+			break
+		}
+	}
+	metrics.latencySumUs.Add(dur.Microseconds())
+}
+
+func observeRetry(reason string) {
+	for i, r := range retryReasons {
+		if r == reason {
+			metrics.retries[i].Add(1)
+			return
+		}
+	}
+}
+
+func totalRetries() int64 {
+	var n int64
+	for i := range metrics.retries {
+		n += metrics.retries[i].Load()
+	}
+	return n
+}
+
+// startStatsHeartbeat logs a load snapshot every STATS_INTERVAL_SEC.
+func startStatsHeartbeat() {
+	go func() {
+		for range time.Tick(time.Duration(statsIntervalSec) * time.Second) {
+			jlog(map[string]any{
+				"at":             "stats",
+				"in_flight":      inFlight.Load(),
+				"requests_total": metrics.requests.Load(),
+				"retries_total":  totalRetries(),
+				"upstream_conns": upstreamConns.Load(),
+				"goroutines":     runtime.NumGoroutine(),
+			})
+		}
+	}()
+}
+
+// metricsHandler serves the Prometheus text exposition format. It reports
+// whether the request path was the metrics path.
+func metricsHandler(ctx *fasthttp.RequestCtx) bool {
+	if string(ctx.Path()) != metricsPath {
+		return false
+	}
+	if !adminAuthorized(ctx) {
+		return true
+	}
+
+	var b bytes.Buffer
+	total := metrics.requests.Load()
+
+	fmt.Fprintln(&b, "# HELP roproxy_requests_total Total requests handled.")
+	fmt.Fprintln(&b, "# TYPE roproxy_requests_total counter")
+	fmt.Fprintf(&b, "roproxy_requests_total %d\n", total)
+
+	fmt.Fprintln(&b, "# HELP roproxy_in_flight_requests Requests currently being handled.")
+	fmt.Fprintln(&b, "# TYPE roproxy_in_flight_requests gauge")
+	fmt.Fprintf(&b, "roproxy_in_flight_requests %d\n", inFlight.Load())
+
+	fmt.Fprintln(&b, "# HELP roproxy_responses_total Responses by status class.")
+	fmt.Fprintln(&b, "# TYPE roproxy_responses_total counter")
+	for i, class := range statusClasses {
+		fmt.Fprintf(&b, "roproxy_responses_total{class=%q} %d\n", class, metrics.byClass[i].Load())
+	}
+
+	fmt.Fprintln(&b, "# HELP roproxy_retries_total Upstream retries by reason.")
+	fmt.Fprintln(&b, "# TYPE roproxy_retries_total counter")
+	for i, reason := range retryReasons {
+		fmt.Fprintf(&b, "roproxy_retries_total{reason=%q} %d\n", reason, metrics.retries[i].Load())
+	}
+
+	fmt.Fprintln(&b, "# HELP roproxy_request_duration_seconds End-to-end request latency.")
+	fmt.Fprintln(&b, "# TYPE roproxy_request_duration_seconds histogram")
+	var cumulative int64
+	for i, le := range latencyBuckets {
+		cumulative += metrics.latencyCounts[i].Load()
+		fmt.Fprintf(&b, "roproxy_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(&b, "roproxy_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", total)
+	fmt.Fprintf(&b, "roproxy_request_duration_seconds_sum %g\n", float64(metrics.latencySumUs.Load())/1e6)
+	fmt.Fprintf(&b, "roproxy_request_duration_seconds_count %d\n", total)
+
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetBody(b.Bytes())
+	return true
+}
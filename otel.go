@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// OTLP trace export, over HTTP with JSON encoding so no OpenTelemetry SDK
+// is needed. Nothing is started unless OTEL_EXPORTER_OTLP_ENDPOINT is set.
+var otelEndpoint = getEnvOTLPEndpoint("OTEL_EXPORTER_OTLP_ENDPOINT")
+var otelHeaders = getEnvOTLPHeaders("OTEL_EXPORTER_OTLP_HEADERS")
+var otelServiceName = getEnvString("OTEL_SERVICE_NAME", "roproxy")
+var otelProtocol = getEnvString("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json")
+
+const otelBatchSize = 512
+const otelFlushInterval = 5 * time.Second
+
+var otelQueue chan *otelSpan
+var otelDropped atomic.Int64
+var otelFlush = make(chan chan struct{})
+
+func init() {
+	if otelEndpoint != "" && otelProtocol != "http/json" {
+		configError("OTEL_EXPORTER_OTLP_PROTOCOL", fmt.Errorf("only http/json is supported, got %q", otelProtocol))
+	}
+}
+
+func otelEnabled() bool {
+	return otelEndpoint != ""
+}
+
+// getEnvOTLPEndpoint reads an http(s) collector base URL; spans are posted
+// to its /v1/traces.
+func getEnvOTLPEndpoint(key string) string {
+	val := getEnv(key)
+	if val == "" {
+		return ""
+	}
+	u, err := url.Parse(val)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		configError(key, fmt.Errorf("invalid http(s) URL %q", val))
+		return ""
+	}
+	return strings.TrimRight(val, "/") + "/v1/traces"
+}
+
+// getEnvOTLPHeaders reads comma-separated key=value pairs sent with every
+// export, as in "x-api-key=secret".
+func getEnvOTLPHeaders(key string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range getEnvList(key, "") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			configError(key, fmt.Errorf("expected key=value, got %q", pair))
+			continue
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+type otelSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        int64       `json:"startTimeUnixNano,string"`
+	End          int64       `json:"endTimeUnixNano,string"`
+	Attributes   []otelAttr  `json:"attributes"`
+	Events       []otelEvent `json:"events,omitempty"`
+	Status       otelStatus  `json:"status"`
+}
+
+type otelAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otelEvent struct {
+	Time       int64      `json:"timeUnixNano,string"`
+	Name       string     `json:"name"`
+	Attributes []otelAttr `json:"attributes"`
+}
+
+type otelStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+func attr(key string, v any) otelAttr {
+	switch v := v.(type) {
+	case int:
+		return otelAttr{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	case bool:
+		return otelAttr{key, map[string]any{"boolValue": v}}
+	default:
+		return otelAttr{key, map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+// recordError marks s failed with err, as an exception event.
+func (s *otelSpan) recordError(err error) {
+	s.Status = otelStatus{Code: 2, Message: err.Error()}
+	s.Events = append(s.Events, otelEvent{
+		Time:       time.Now().UnixNano(),
+		Name:       "exception",
+		Attributes: []otelAttr{attr("exception.message", err.Error())},
+	})
+}
+
+// startRequestSpan opens the server span for a proxied request, continuing
+// the incoming traceparent when there is one. A parent that isn't sampled
+// means no spans are recorded for the request.
+func startRequestSpan(ctx *fasthttp.RequestCtx) {
+	if !otelEnabled() {
+		return
+	}
+	traceID, _ := ctx.UserValue("trace_id").(string)
+	tp := string(ctx.Request.Header.Peek("traceparent"))
+	parent := ""
+	if traceID != "" && traceIDFrom(tp) == traceID {
+		if strings.HasSuffix(tp, "-00") {
+			return
+		}
+		parent = tp[36:52]
+	}
+	if traceID == "" {
+		traceID = randomHex(16)
+		ctx.SetUserValue("trace_id", traceID)
+		ctx.Response.Header.Set("X-Trace-ID", traceID)
+	}
+	ctx.SetUserValue("span", &otelSpan{
+		TraceID:      traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parent,
+		Name:         string(ctx.Method()),
+		Kind:         spanKindServer,
+		Start:        time.Now().UnixNano(),
+	})
+}
+
+// endRequestSpan closes the request's span with what the request ended up
+// doing: upstream host, status, retries and cache state.
+func endRequestSpan(ctx *fasthttp.RequestCtx) {
+	s, ok := ctx.UserValue("span").(*otelSpan)
+	if !ok {
+		return
+	}
+	status := ctx.Response.StatusCode()
+	s.End = time.Now().UnixNano()
+	s.Attributes = append(s.Attributes,
+		attr("http.request.method", string(ctx.Method())),
+		attr("url.path", string(ctx.Path())),
+		attr("http.response.status_code", status))
+	if host, ok := ctx.UserValue("upstream_host").(string); ok {
+		s.Attributes = append(s.Attributes, attr("proxy.upstream_host", host))
+	}
+	if n, ok := ctx.UserValue("attempts").(int); ok {
+		s.Attributes = append(s.Attributes, attr("proxy.retries", n-1))
+	}
+	if cache, ok := ctx.UserValue("cache").(string); ok {
+		s.Attributes = append(s.Attributes, attr("proxy.cache", cache))
+	}
+	if status >= 500 && s.Status.Code == 0 {
+		s.Status = otelStatus{Code: 2, Message: fasthttp.StatusMessage(status)}
+	}
+	exportSpan(s)
+}
+
+// startAttemptSpan opens a client span for one upstream attempt, as a child
+// of the request's span, and points req's traceparent at it so the upstream
+// continues the trace. It returns nil when the request isn't traced.
+func startAttemptSpan(ctx *fasthttp.RequestCtx, req *fasthttp.Request, host string, attempt int) *otelSpan {
+	parent, ok := ctx.UserValue("span").(*otelSpan)
+	if !ok {
+		return nil
+	}
+	s := &otelSpan{
+		TraceID:      parent.TraceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parent.SpanID,
+		Name:         string(ctx.Method()) + " " + host,
+		Kind:         spanKindClient,
+		Start:        time.Now().UnixNano(),
+		Attributes: []otelAttr{
+			attr("server.address", host),
+			attr("http.request.method", string(ctx.Method())),
+			attr("http.request.resend_count", attempt-1),
+		},
+	}
+	req.Header.Set("traceparent", "00-"+s.TraceID+"-"+s.SpanID+"-01")
+	return s
+}
+
+// endAttemptSpan closes an attempt's span with its status or error.
+func endAttemptSpan(s *otelSpan, resp *fasthttp.Response, err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now().UnixNano()
+	if err != nil {
+		s.recordError(err)
+	} else {
+		sc := resp.StatusCode()
+		s.Attributes = append(s.Attributes, attr("http.response.status_code", sc))
+		if sc >= 500 {
+			s.Status = otelStatus{Code: 2}
+		}
+	}
+	exportSpan(s)
+}
+
+// exportSpan queues s for the exporter, dropping it if the queue is full
+// rather than holding up the request.
+func exportSpan(s *otelSpan) {
+	select {
+	case otelQueue <- s:
+	default:
+		otelDropped.Add(1)
+	}
+}
+
+// startOTLPExporter posts queued spans to the collector in batches of up
+// to otelBatchSize, at least every otelFlushInterval.
+func startOTLPExporter() {
+	otelQueue = make(chan *otelSpan, 4*otelBatchSize)
+	go func() {
+		ticker := time.NewTicker(otelFlushInterval)
+		defer ticker.Stop()
+		batch := make([]*otelSpan, 0, otelBatchSize)
+		send := func() {
+			if n := otelDropped.Swap(0); n > 0 {
+				jlog(map[string]any{"at": "otel_dropped", "level": "warn", "spans": n})
+			}
+			if len(batch) > 0 {
+				postSpans(batch)
+				batch = batch[:0]
+			}
+		}
+		for {
+			select {
+			case s := <-otelQueue:
+				batch = append(batch, s)
+				if len(batch) >= otelBatchSize {
+					send()
+				}
+			case <-ticker.C:
+				send()
+			case done := <-otelFlush:
+				for len(otelQueue) > 0 {
+					batch = append(batch, <-otelQueue)
+				}
+				send()
+				close(done)
+			}
+		}
+	}()
+}
+
+// flushSpans exports whatever is queued, waiting at most a few seconds.
+func flushSpans() {
+	if otelQueue == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case otelFlush <- done:
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	case <-time.After(5 * time.Second):
+	}
+}
+
+var otelClient = &http.Client{Timeout: 10 * time.Second}
+
+func postSpans(spans []*otelSpan) {
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otelAttr{attr("service.name", otelServiceName)}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "roproxy"},
+				"spans": spans,
+			}},
+		}},
+	})
+	req, _ := http.NewRequest("POST", otelEndpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range otelHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := otelClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("collector returned %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		jlog(map[string]any{"at": "otel_export_failed", "level": "warn", "spans": len(spans), "err": err.Error()})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp/prefork"
+)
+
+// With PREFORK the first process only holds the listener and supervises
+// one child per core, each running the full proxy. Everything kept in
+// memory (caches, rate limiters, quotas, breakers, metrics) is therefore
+// per child, and SIGHUP has to be sent to the children, e.g. to the whole
+// process group.
+var preforkEnabled = getEnvBool("PREFORK")
+
+func init() {
+	if !preforkEnabled {
+		return
+	}
+	if listenSocket != "" {
+		configError("PREFORK", errors.New("can't be combined with LISTEN_SOCKET"))
+	}
+	if adminPort != "" {
+		configError("PREFORK", errors.New("can't be combined with ADMIN_PORT, every child would need the port"))
+	}
+}
+
+// workerName identifies this process in logs.
+func workerName() string {
+	if !preforkEnabled {
+		return "single"
+	}
+	if prefork.IsChild() {
+		return "child-" + strconv.Itoa(os.Getpid())
+	}
+	return "master-" + strconv.Itoa(os.Getpid())
+}
+
+// watchParent shuts a prefork child down gracefully once the master that
+// started it has gone, rather than leaving it orphaned.
+func watchParent() {
+	ppid := os.Getppid()
+	for range time.Tick(time.Second) {
+		if os.Getppid() != ppid {
+			if self, err := os.FindProcess(os.Getpid()); err == nil {
+				self.Signal(syscall.SIGTERM)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocol = getEnvBool("PROXY_PROTOCOL")
+var proxyProtocolTrusted = getEnvCIDRs("PROXY_PROTOCOL_TRUSTED_CIDRS")
+
+func init() {
+	if !proxyProtocol {
+		return
+	}
+	if len(proxyProtocolTrusted) == 0 {
+		configError("PROXY_PROTOCOL_TRUSTED_CIDRS", errors.New("must list the load balancers allowed to send PROXY headers"))
+	}
+	if listenSocket != "" {
+		configError("PROXY_PROTOCOL", errors.New("can't be combined with LISTEN_SOCKET"))
+	}
+}
+
+// getEnvCIDRs parses a comma-separated list of CIDRs. A bare IP is taken
+// as a single-address network.
+func getEnvCIDRs(key string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range getEnvList(key, "") {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			configError(key, fmt.Errorf("invalid CIDR %q", item))
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoConn reads a PROXY protocol v1 or v2 header off the start of
+// the connection, on first use rather than in Accept so a slow peer can't
+// stall the accept loop. Only peers in PROXY_PROTOCOL_TRUSTED_CIDRS are
+// believed; from anyone else the bytes are passed through untouched and
+// fail as a malformed request. A trusted peer that sends no header, or a
+// LOCAL/UNKNOWN one, keeps its own address.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		peer, ok := c.remote.(*net.TCPAddr)
+		if !ok || !ipInNets(peer.IP, proxyProtocolTrusted) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		var addr net.Addr
+		addr, c.err = readProxyHeader(c.r)
+		if addr != nil {
+			c.remote = addr
+			jlog(map[string]any{"at": "proxy_protocol", "level": "debug", "peer": peer.String(), "client": addr.String()})
+		}
+		if c.err != nil {
+			jlog(map[string]any{"at": "proxy_protocol_error", "level": "warn", "peer": peer.String(), "err": c.err.Error()})
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// NetConn returns the wrapped connection, as tls.Conn does, so clientGone
+// can reach the socket.
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader consumes a PROXY header if r starts with one and returns
+// the client address it carries, or nil when there is none to use.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if prefix, _ := r.Peek(6); string(prefix) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("malformed PROXY v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 { // LOCAL, e.g. a load balancer health check
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
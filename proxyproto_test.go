@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a PROXY v2 header with the given command, family and
+// declared length, followed by body.
+func proxyV2(cmd, family byte, length int, body []byte) string {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(length))
+	return string(append(hdr, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	inet := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	for _, tc := range []struct {
+		name, input string
+		addr        string // "" for none
+		err         bool
+		rest        string // left for the HTTP parser
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 203.0.113.7 10.0.0.1 12345 443\r\nGET /", addr: "203.0.113.7:12345", rest: "GET /"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::7 2001:db8::1 12345 443\r\n", addr: "[2001:db8::7]:12345"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nGET /", rest: "GET /"},
+		{name: "v1 unknown with addresses", input: "PROXY UNKNOWN 203.0.113.7 10.0.0.1 12345 443\r\n"},
+		{name: "v1 truncated", input: "PROXY TCP4 203.0.113.7 10.0", err: true},
+		{name: "v1 missing CR", input: "PROXY TCP4 203.0.113.7 10.0.0.1 12345 443\n", err: true},
+		{name: "v1 overlong", input: "PROXY TCP4 " + strings.Repeat("1", 100) + " 10.0.0.1 1 2\r\n", err: true},
+		{name: "v1 past the read buffer", input: "PROXY TCP4 " + strings.Repeat("1", 5000) + "\r\n", err: true},
+		{name: "v1 bad protocol", input: "PROXY UDP4 203.0.113.7 10.0.0.1 12345 443\r\n", err: true},
+		{name: "v1 bad address", input: "PROXY TCP4 203.0.113.300 10.0.0.1 12345 443\r\n", err: true},
+		{name: "v1 bad port", input: "PROXY TCP4 203.0.113.7 10.0.0.1 99999 443\r\n", err: true},
+		{name: "v2 inet", input: proxyV2(1, 0x11, len(inet), inet) + "GET /", addr: "203.0.113.7:12345", rest: "GET /"},
+		{name: "v2 local", input: proxyV2(0, 0x11, len(inet), inet)},
+		{name: "v2 unspecified family", input: proxyV2(1, 0x00, 0, nil)},
+		{name: "v2 bad signature", input: "\r\n\r\n\x00\r\nQUIT!" + proxyV2(1, 0x11, len(inet), inet)[12:], rest: "\r\n\r\n\x00\r\nQUIT!"},
+		{name: "v2 bad version", input: strings.Replace(proxyV2(1, 0x11, len(inet), inet), "\x21", "\x31", 1), err: true},
+		{name: "v2 length past the data", input: proxyV2(1, 0x11, 200, inet), err: true},
+		{name: "v2 truncated header", input: proxyV2(1, 0x11, len(inet), inet)[:14], err: true},
+		{name: "v2 short inet address", input: proxyV2(1, 0x11, 4, inet[:4]), err: true},
+		{name: "v2 short inet6 address", input: proxyV2(1, 0x21, len(inet), inet), err: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n", rest: "GET / HTTP/1.1\r\n"},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.input))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.addr {
+			t.Errorf("%s: got address %q, want %q", tc.name, got, tc.addr)
+		}
+		if rest, _ := io.ReadAll(r); !strings.HasPrefix(string(rest), tc.rest) {
+			t.Errorf("%s: left %q, want it to start with %q", tc.name, rest, tc.rest)
+		}
+	}
+}
+
+func TestProxyHeaderFromUntrustedPeer(t *testing.T) {
+	defer func(saved []*net.IPNet) { proxyProtocolTrusted = saved }(proxyProtocolTrusted)
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 12345 443\r\n"
+
+	for _, tc := range []struct {
+		trusted string
+		remote  string // "" for the peer's own address
+		read    string
+	}{
+		{trusted: "10.0.0.0/8", read: header + "GET /"},
+		{trusted: "127.0.0.1/32", remote: "203.0.113.7:12345", read: "GET /"},
+	} {
+		_, trusted, _ := net.ParseCIDR(tc.trusted)
+		proxyProtocolTrusted = []*net.IPNet{trusted}
+
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := proxyProtoListener{tcp}
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(header + "GET /"))
+		client.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := tc.remote
+		if want == "" {
+			want = client.LocalAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("trusting %s: remote %s, want %s", tc.trusted, got, want)
+		}
+		if b, _ := io.ReadAll(conn); string(b) != tc.read {
+			t.Errorf("trusting %s: read %q, want %q", tc.trusted, b, tc.read)
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var keyQuota = getEnvInt("KEY_QUOTA", 0)
+var keyQuotaWindowSec = getEnvPositiveInt("KEY_QUOTA_WINDOW_SEC", 60)
+
+type quotaWindow struct {
+	start time.Time
+	count int
+}
+
+var quotaMu sync.Mutex
+var quotaWindows = map[string]*quotaWindow{}
+
+func startQuotaEviction() {
+	window := time.Duration(keyQuotaWindowSec) * time.Second
+	go func() {
+		for range time.Tick(window) {
+			cutoff := time.Now().Add(-window)
+			quotaMu.Lock()
+			for key, w := range quotaWindows {
+				if w.start.Before(cutoff) {
+					delete(quotaWindows, key)
+				}
+			}
+			quotaMu.Unlock()
+		}
+	}()
+}
+
+// enforceQuota counts the request against its key's fixed window of
+// KEY_QUOTA requests, writing a 429 once the window is used up. It reports
+// whether the request was rejected.
+func enforceQuota(ctx *fasthttp.RequestCtx) bool {
+	label, ok := ctx.UserValue("key_label").(string)
+	if keyQuota <= 0 || !ok {
+		return false
+	}
+
+	now := time.Now()
+	window := time.Duration(keyQuotaWindowSec) * time.Second
+	quotaMu.Lock()
+	w, ok := quotaWindows[label]
+	if !ok || now.Sub(w.start) >= window {
+		w = &quotaWindow{start: now}
+		quotaWindows[label] = w
+	}
+	w.count++
+	remaining := keyQuota - w.count
+	reset := w.start.Add(window).Sub(now)
+	quotaMu.Unlock()
+
+	if remaining >= 0 {
+		ctx.Response.Header.Set("X-Quota-Remaining", strconv.Itoa(remaining))
+		return false
+	}
+	rlog(ctx, map[string]any{"at": "quota_exceeded", "level": "warn", "quota": keyQuota, "window_sec": keyQuotaWindowSec})
+	setError(&ctx.Response, 429, "quota_exceeded", "Key quota exceeded.")
+	ctx.Response.Header.Set("X-Quota-Remaining", "0")
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(reset.Seconds())+1))
+	return true
+}
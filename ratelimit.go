@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var rateLimitRPS = getEnvFloat("RATE_LIMIT_RPS", 0)
+var rateLimitBurst = getEnvPositiveInt("RATE_LIMIT_BURST", int(math.Max(1, math.Ceil(rateLimitRPS))))
+
+var upstreamRPS = getEnvFloat("UPSTREAM_RPS", 0)
+var upstreamBurst = getEnvPositiveInt("UPSTREAM_BURST", int(math.Max(1, math.Ceil(upstreamRPS))))
+var upstreamMaxWaitMs = getEnvPositiveInt("UPSTREAM_MAX_WAIT_MS", 1000)
+
+var ipLimiter *keyedLimiter
+
+var upstreamMu sync.Mutex
+var upstreamBucket tokenBucket
+var upstreamWaiting atomic.Int64
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// take refills the bucket for the time elapsed since the last call and
+// consumes a token if one is available. When none is, it returns how long
+// until the next token becomes available.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.refill(now, rate, burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// reserve is like take but lets the bucket go into debt: the token is
+// claimed now and the caller must wait the returned duration before using
+// it. Nothing is claimed if the wait would exceed maxWait.
+func (b *tokenBucket) reserve(now time.Time, rate float64, burst int, maxWait time.Duration) (time.Duration, bool) {
+	b.refill(now, rate, burst)
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// keyedLimiter keeps one token bucket per key, evicting buckets that have
+// been idle long enough to have refilled completely.
+type keyedLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+func newKeyedLimiter(rate float64, burst int) *keyedLimiter {
+	l := &keyedLimiter{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+	go l.evictLoop()
+	return l
+}
+
+func (l *keyedLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now, l.rate, l.burst)
+}
+
+func (l *keyedLimiter) evictLoop() {
+	idle := time.Duration(float64(l.burst)/l.rate*float64(time.Second)) + time.Minute
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-idle)
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if b.last.Before(cutoff) {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimitIP rejects the request with 429 when the client IP is over its
+// limit. It reports whether the request was rejected.
+func rateLimitIP(ctx *fasthttp.RequestCtx) bool {
+	if ipLimiter == nil {
+		return false
+	}
+	remote := clientIP(ctx).String()
+	ok, wait := ipLimiter.allow(remote)
+	if ok {
+		return false
+	}
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	rlog(ctx, map[string]any{"at": "rate_limited", "level": "warn", "remote": remote, "retry_after": retryAfter})
+	setError(&ctx.Response, 429, "rate_limited", "Too many requests.")
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+	return true
+}
+
+func startUpstreamLimiter() {
+	upstreamBucket = tokenBucket{tokens: float64(upstreamBurst), last: time.Now()}
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			jlog(map[string]any{"at": "upstream_limiter", "waiting": upstreamWaiting.Load()})
+		}
+	}()
+}
+
+// awaitUpstreamToken blocks until the global upstream limiter admits another
+// call. It reports false without waiting if the caller would have to wait
+// longer than UPSTREAM_MAX_WAIT_MS.
+func awaitUpstreamToken() bool {
+	if upstreamRPS <= 0 {
+		return true
+	}
+	upstreamMu.Lock()
+	wait, ok := upstreamBucket.reserve(time.Now(), upstreamRPS, upstreamBurst, time.Duration(upstreamMaxWaitMs)*time.Millisecond)
+	upstreamMu.Unlock()
+	if !ok {
+		return false
+	}
+	if wait > 0 {
+		upstreamWaiting.Add(1)
+		time.Sleep(wait)
+		upstreamWaiting.Add(-1)
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+)
+
+// liveConfig holds the settings that can be changed on SIGHUP without
+// restarting the listener. Requests read it through conf() and see either
+// the old or the new values, never a mix.
+type liveConfig struct {
+	ProxyKeys     []proxyKey
+	Retries       int
+	LogSlowMs     int
+	LogErrorsOnly bool
+	LogLevel      int
+	LogBodies     bool
+}
+
+// restartConfig holds settings baked into the upstream client or listener
+// at startup. They are re-read on SIGHUP only to report that a change needs
+// a restart to take effect.
+type restartConfig struct {
+	Timeout                int
+	WriteTimeout           int
+	DialTimeout            int
+	MaxConnsPerHost        int
+	MaxIdleConnDurationSec int
+}
+
+var liveConf atomic.Pointer[liveConfig]
+var startupConf = loadRestartConfig()
+
+func init() {
+	liveConf.Store(loadLiveConfig())
+}
+
+func conf() *liveConfig {
+	return liveConf.Load()
+}
+
+func loadLiveConfig() *liveConfig {
+	return &liveConfig{
+		ProxyKeys:     loadProxyKeys(),
+		Retries:       getEnvNonNegativeInt("RETRIES", 5),
+		LogSlowMs:     getEnvInt("LOG_SLOW_MS", 300),
+		LogErrorsOnly: getEnvBool("LOG_ERRORS_ONLY"),
+		LogLevel:      getEnvLogLevel("LOG_LEVEL", "debug"),
+		LogBodies:     getEnvBool("LOG_BODIES"),
+	}
+}
+
+func loadRestartConfig() restartConfig {
+	timeout := getEnvNonNegativeInt("TIMEOUT", 15)
+	return restartConfig{
+		Timeout:                timeout,
+		WriteTimeout:           getEnvPositiveInt("WRITE_TIMEOUT", timeout),
+		DialTimeout:            getEnvPositiveInt("DIAL_TIMEOUT", 5),
+		MaxConnsPerHost:        getEnvPositiveInt("MAX_CONNS_PER_HOST", 16),
+		MaxIdleConnDurationSec: getEnvPositiveInt("MAX_IDLE_CONN_DURATION_SEC", 60),
+	}
+}
+
+// reloadConfig re-reads CONFIG_FILE and the live settings and swaps them
+// in, unless any of them fail to parse. Environment variables can't change
+// under a running process, so in practice this picks up edits to
+// CONFIG_FILE and KEYS_FILE.
+func reloadConfig() {
+	prevSettings := fileSettings
+	if configFile != "" {
+		settings, err := readConfigFile(configFile)
+		if err != nil {
+			jlog(map[string]any{"at": "config_reload_failed", "level": "error", "errors": []string{err.Error()}})
+			return
+		}
+		fileSettings = settings
+	}
+
+	before := len(configErrors)
+	next := loadLiveConfig()
+	restart := loadRestartConfig()
+	if errs := configErrors[before:]; len(errs) > 0 {
+		fileSettings = prevSettings
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		configErrors = configErrors[:before]
+		jlog(map[string]any{"at": "config_reload_failed", "level": "error", "errors": msgs})
+		return
+	}
+
+	prev := liveConf.Swap(next)
+	jlog(map[string]any{
+		"at":               "config_reloaded",
+		"changed":          changedFields(*prev, *next),
+		"restart_required": changedFields(startupConf, restart),
+	})
+}
+
+// changedFields lists the names of the fields that differ between two
+// values of the same struct type.
+func changedFields(a, b any) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	changed := []string{}
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// handleSIGHUP reloads the live config, and the TLS certificate when
+// serving TLS, on every SIGHUP.
+func handleSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		reloadConfig()
+		if tlsEnabled() {
+			reloadCertificate()
+		}
+	}
+}
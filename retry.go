@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var retryStatuses = getEnvStatusSet("RETRY_STATUSES", "500-599")
+var sleepOn429 = getEnvString("SLEEP_ON_429", "true") == "true"
+var retry429 = getEnvBool("RETRY_429")
+var retry503After = getEnvString("RETRY_503_AFTER", "true") == "true"
+var retryMethods = methodSet(getEnvList("RETRY_METHODS", "GET,HEAD,OPTIONS,PUT,DELETE"))
+
+func methodSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		set[strings.ToUpper(m)] = true
+	}
+	return set
+}
+
+// getEnvStatusSet parses a comma-separated list of status codes and
+// inclusive ranges such as "500-504,408".
+func getEnvStatusSet(key string, fallback string) [600]bool {
+	var set [600]bool
+	for _, item := range getEnvList(key, fallback) {
+		lo, hi, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err != nil || from < 100 || to > 599 || from > to {
+			configError(key, fmt.Errorf("invalid status or range %q", item))
+			continue
+		}
+		for sc := from; sc <= to; sc++ {
+			set[sc] = true
+		}
+	}
+	return set
+}
+
+type retrySafeRule struct {
+	rule   string
+	method string // "*" for any
+	host   string // "" for any
+	match  *regexp.Regexp
+	safe   bool
+}
+
+var retrySafeRules = getEnvRetrySafeRules("RETRY_SAFE_RULES")
+
+// getEnvRetrySafeRules parses semicolon-separated "METHOD pattern=safe" or
+// "=unsafe" rules. The pattern is an optional host followed by a path glob,
+// where * stands for any run of characters, as in
+// "PATCH /v1/users/*/settings=safe", or by ~ and a regular expression, as in
+// "POST economy.roblox.com~^/v1/purchases=unsafe". A method of * matches
+// any method.
+func getEnvRetrySafeRules(key string) []retrySafeRule {
+	var rules []retrySafeRule
+	for _, item := range strings.Split(getEnv(key), ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		spec, verdict, _ := strings.Cut(item, "=")
+		method, pattern, _ := strings.Cut(strings.TrimSpace(spec), " ")
+		pattern = strings.TrimSpace(pattern)
+		verdict = strings.TrimSpace(verdict)
+		if verdict != "safe" && verdict != "unsafe" || method == "" || pattern == "" {
+			configError(key, fmt.Errorf("invalid rule %q, want METHOD pattern=safe or =unsafe", item))
+			continue
+		}
+		r := retrySafeRule{rule: item, method: strings.ToUpper(method), safe: verdict == "safe"}
+		var expr string
+		if host, re, isRegexp := strings.Cut(pattern, "~"); isRegexp {
+			r.host, expr = host, re
+		} else if i := strings.IndexByte(pattern, '/'); i >= 0 {
+			r.host = pattern[:i]
+			expr = "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern[i:]), `\*`, ".*") + "$"
+		} else {
+			configError(key, fmt.Errorf("invalid rule %q, pattern needs a /path or ~regex", item))
+			continue
+		}
+		if r.host != "" && !validHost(r.host) {
+			configError(key, fmt.Errorf("rule %q: invalid host %q", item, r.host))
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			configError(key, fmt.Errorf("rule %q: %w", item, err))
+			continue
+		}
+		r.host, r.match = strings.ToLower(r.host), re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// retryableMethod reports whether the request may be retried after the
+// upstream may have seen it, as decided by retryVerdict for the current
+// attempt.
+func retryableMethod(ctx *fasthttp.RequestCtx) bool {
+	if safe, ok := ctx.UserValue("retry_safe").(bool); ok {
+		return safe
+	}
+	return retryMethods[string(ctx.Method())]
+}
+
+// retryVerdict records whether a request sent to host with path, as it goes
+// upstream after rewrites and failover, may be retried: by the first
+// RETRY_SAFE_RULES entry matching its method and target, or else by
+// RETRY_METHODS. makeRequest calls it for every attempt, since failover can
+// change the host.
+func retryVerdict(ctx *fasthttp.RequestCtx, host string, path string) {
+	method := string(ctx.Method())
+	safe := retryMethods[method]
+	host = strings.ToLower(host)
+	for _, r := range retrySafeRules {
+		if (r.method == "*" || r.method == method) && (r.host == "" || r.host == host) && r.match.MatchString(path) {
+			rlog(ctx, map[string]any{"at": "retry_safe_rule", "level": "debug", "rule": r.rule, "safe": r.safe, "method": method, "host": host, "path": path})
+			safe = r.safe
+			break
+		}
+	}
+	ctx.SetUserValue("retry_safe", safe)
+}
+
+// isDialError reports whether err happened while establishing the upstream
+// connection, before any part of the request was written. Such errors are
+// safe to retry regardless of method.
+func isDialError(err error) bool {
+	if errors.Is(err, fasthttp.ErrDialTimeout) || errors.Is(err, fasthttp.ErrNoFreeConns) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, fasthttp.ErrTimeout) || errors.Is(err, fasthttp.ErrDialTimeout) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errorClass sorts an upstream error into "transient", worth retrying, or
+// "permanent", which won't go away on its own. Only errors known to be
+// transient are retried; anything unrecognised is treated as permanent.
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout || dnsErr.IsTemporary {
+			return "transient"
+		}
+		return "permanent"
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, fasthttp.ErrDialTimeout),
+		errors.Is(err, fasthttp.ErrTimeout),
+		errors.Is(err, fasthttp.ErrNoFreeConns),
+		errors.Is(err, fasthttp.ErrConnectionClosed),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "transient"
+	}
+	return "permanent"
+}
+
+var maxRetryAfterSec = getEnvNonNegativeInt("MAX_RETRY_AFTER_SEC", 0)
+var retryAfterOverCap = getEnvString("RETRY_AFTER_OVER_CAP", "clamp")
+var retryAfterReturn = retryAfterOverCap == "return"
+
+func init() {
+	if retryAfterOverCap != "clamp" && retryAfterOverCap != "return" {
+		configError("RETRY_AFTER_OVER_CAP", fmt.Errorf("must be clamp or return, got %q", retryAfterOverCap))
+	}
+}
+
+// parseRetryAfter reads a Retry-After value given either as delay-seconds
+// or as an HTTP-date.
+func parseRetryAfter(v []byte) (time.Duration, bool) {
+	if s, err := strconv.Atoi(string(v)); err == nil {
+		return time.Duration(s) * time.Second, s > 0
+	}
+	if t, err := fasthttp.ParseHTTPDate(v); err == nil {
+		d := time.Until(t)
+		return d, d > 0
+	}
+	return 0, false
+}
+
+// retryAfterSleep returns how long to wait on resp's Retry-After, capped at
+// MAX_RETRY_AFTER_SEC, or BACKOFF_MAX_MS when that's unset, and zero when
+// there's no usable Retry-After. It reports false when the delay is over
+// the cap and RETRY_AFTER_OVER_CAP=return, meaning the 429 should go
+// straight back to the client.
+func retryAfterSleep(ctx *fasthttp.RequestCtx, resp *fasthttp.Response) (time.Duration, bool) {
+	ra := resp.Header.Peek("Retry-After")
+	parsed, ok := parseRetryAfter(ra)
+	if !ok {
+		return 0, true
+	}
+	limit := time.Duration(backoffMaxMs) * time.Millisecond
+	if maxRetryAfterSec > 0 {
+		limit = time.Duration(maxRetryAfterSec) * time.Second
+	}
+	if parsed > limit && retryAfterReturn {
+		rlog(ctx, map[string]any{"at": "retry_after", "level": "debug", "retry_after": string(ra), "parsed_ms": parsed.Milliseconds(), "sleep_ms": 0})
+		return 0, false
+	}
+	sleep := min(parsed+100*time.Millisecond, limit)
+	rlog(ctx, map[string]any{"at": "retry_after", "level": "debug", "retry_after": string(ra), "parsed_ms": parsed.Milliseconds(), "sleep_ms": sleep.Milliseconds()})
+	return sleep, true
+}
+
+type bodyPattern struct {
+	pattern string
+	match   *regexp.Regexp
+}
+
+var retryBodyPatterns = getEnvBodyPatterns("RETRY_BODY_PATTERNS")
+var retryBodyMaxBytes = getEnvPositiveInt("RETRY_BODY_MAX_BYTES", 4096)
+
+// getEnvBodyPatterns compiles semicolon-separated patterns, each a plain
+// substring or, after a ~, a regular expression.
+func getEnvBodyPatterns(key string) []bodyPattern {
+	var patterns []bodyPattern
+	for _, item := range strings.Split(getEnv(key), ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		expr, isRegexp := strings.CutPrefix(item, "~")
+		if !isRegexp {
+			expr = regexp.QuoteMeta(item)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			configError(key, fmt.Errorf("pattern %q: %w", item, err))
+			continue
+		}
+		patterns = append(patterns, bodyPattern{pattern: item, match: re})
+	}
+	return patterns
+}
+
+// retryBodyMatch returns the RETRY_BODY_PATTERNS entry found in the first
+// RETRY_BODY_MAX_BYTES of a 200 response's body, or "" if none is. Streamed
+// and compressed bodies aren't inspected.
+func retryBodyMatch(resp *fasthttp.Response) string {
+	if len(retryBodyPatterns) == 0 || resp.StatusCode() != 200 || resp.IsBodyStream() ||
+		len(resp.Header.ContentEncoding()) > 0 {
+		return ""
+	}
+	body := resp.Body()
+	if len(body) > retryBodyMaxBytes {
+		body = body[:retryBodyMaxBytes]
+	}
+	for _, p := range retryBodyPatterns {
+		if p.match.Match(body) {
+			return p.pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+type rewriteRule struct {
+	host        string         // empty for any host
+	prefix      string         // for plain rules
+	match       *regexp.Regexp // for ~regex rules
+	replacement string
+}
+
+var rewriteRules = getEnvRewriteRules("REWRITE_RULES")
+
+// getEnvRewriteRules parses semicolon-separated pattern=>replacement rules.
+// A pattern is an optional host followed by a path prefix, as in
+// "users.roblox.com/v1/users=>/v2/users", or by ~ and a regular expression,
+// as in "~^/v1/(\w+)/legacy=>/v2/$1", whose replacement may refer to groups.
+func getEnvRewriteRules(key string) []rewriteRule {
+	var rules []rewriteRule
+	for _, item := range strings.Split(getEnv(key), ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		pattern, replacement, ok := strings.Cut(item, "=>")
+		pattern, replacement = strings.TrimSpace(pattern), strings.TrimSpace(replacement)
+		if !ok || !strings.HasPrefix(replacement, "/") {
+			configError(key, fmt.Errorf("invalid rule %q, want pattern=>/replacement", item))
+			continue
+		}
+		r := rewriteRule{replacement: replacement}
+		if host, expr, isRegexp := strings.Cut(pattern, "~"); isRegexp {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				configError(key, fmt.Errorf("rule %q: %w", item, err))
+				continue
+			}
+			r.host, r.match = host, re
+		} else if i := strings.IndexByte(pattern, '/'); i >= 0 {
+			r.host, r.prefix = pattern[:i], pattern[i:]
+		} else {
+			configError(key, fmt.Errorf("invalid rule %q, pattern needs a /path or ~regex", item))
+			continue
+		}
+		if r.host != "" && !validHost(r.host) {
+			configError(key, fmt.Errorf("rule %q: invalid host %q", item, r.host))
+			continue
+		}
+		r.host = strings.ToLower(r.host)
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// rewritePath applies the first REWRITE_RULES entry matching host and
+// path, where path has no leading slash, and returns the path to send
+// upstream. Rules see the path without its query string, which is kept
+// as it was.
+func rewritePath(ctx *fasthttp.RequestCtx, host string, path string) string {
+	from, query, hasQuery := strings.Cut("/"+path, "?")
+	for _, r := range rewriteRules {
+		if r.host != "" && !hostMatches(host, []string{r.host}) {
+			continue
+		}
+		to := ""
+		if r.match != nil {
+			if !r.match.MatchString(from) {
+				continue
+			}
+			to = r.match.ReplaceAllString(from, r.replacement)
+		} else {
+			if !strings.HasPrefix(from, r.prefix) {
+				continue
+			}
+			to = r.replacement + from[len(r.prefix):]
+		}
+		if ctx.UserValue("rewritten") == nil {
+			ctx.SetUserValue("rewritten", true)
+			rlog(ctx, map[string]any{"at": "rewrite", "host": host, "from": from, "to": to})
+		}
+		if hasQuery {
+			to += "?" + query
+		}
+		return strings.TrimPrefix(to, "/")
+	}
+	return path
+}
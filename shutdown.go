@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var shutdownGraceSec = getEnvPositiveInt("SHUTDOWN_GRACE_SEC", 30)
+
+// shutdownStarted is closed on SIGTERM or SIGINT, so waits between retries
+// can give up instead of holding up the drain.
+var shutdownStarted = make(chan struct{})
+
+// awaitShutdown blocks until SIGTERM or SIGINT, then stops the servers
+// from accepting new connections and waits up to SHUTDOWN_GRACE_SEC for
+// in-flight requests to finish. Servers are stopped in order, so the admin
+// server keeps answering probes while the proxy drains.
+func awaitShutdown(servers ...*fasthttp.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	received := <-sig
+	close(shutdownStarted)
+
+	pending := inFlight.Load()
+	jlog(map[string]any{"at": "shutdown_begin", "signal": received.String(), "in_flight": pending, "grace_sec": shutdownGraceSec})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownGraceSec)*time.Second)
+	defer cancel()
+	var err error
+	for _, server := range servers {
+		if serr := server.ShutdownWithContext(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if listenSocket != "" {
+		os.Remove(listenSocket)
+	}
+	flushSpans()
+
+	remaining := inFlight.Load()
+	fields := map[string]any{"at": "shutdown_complete", "drained": pending - remaining, "abandoned": remaining}
+	if err != nil {
+		fields["err"] = err.Error()
+	}
+	jlog(fields)
+}
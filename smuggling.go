@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HEADER_VALIDATION=strict rejects requests whose headers could be read
+// differently by the proxy and the upstream; lenient leaves that to fasthttp.
+var headerValidation = getEnvString("HEADER_VALIDATION", "lenient")
+
+func init() {
+	if headerValidation != "strict" && headerValidation != "lenient" {
+		configError("HEADER_VALIDATION", fmt.Errorf("must be strict or lenient, got %q", headerValidation))
+	}
+}
+
+// smugglingBlocked writes a 400 and reports true when, with
+// HEADER_VALIDATION=strict, the request has control characters in a header
+// name or value, a folded header line, or ambiguous framing: Content-Length
+// given more than once with different values, Transfer-Encoding alongside
+// Content-Length, or a Transfer-Encoding other than a single chunked.
+func smugglingBlocked(ctx *fasthttp.RequestCtx) bool {
+	if headerValidation != "strict" {
+		return false
+	}
+	reason, header := headerProblem(ctx)
+	if reason == "" {
+		return false
+	}
+	rlog(ctx, map[string]any{"at": "smuggling_blocked", "level": "warn", "reason": reason, "header": header, "uri": string(ctx.RequestURI()), "remote": clientIP(ctx).String()})
+	setError(&ctx.Response, 400, "invalid_headers", "Malformed or ambiguous request headers.")
+	ctx.SetConnectionClose()
+	return true
+}
+
+func headerProblem(ctx *fasthttp.RequestCtx) (reason string, header string) {
+	ctx.Request.Header.VisitAll(func(k, v []byte) {
+		if reason == "" && (!validHeaderName(string(k)) || hasControlChar(v)) {
+			reason, header = "control_char", string(k)
+		}
+	})
+	if reason != "" {
+		return reason, header
+	}
+
+	// The parsed headers have already folded repeats together, so framing
+	// is checked on the lines as received.
+	var contentLength, transferEncoding [][]byte
+	for _, line := range bytes.Split(ctx.Request.Header.RawHeaders(), []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return "folded_header", ""
+		}
+		k, v, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !validHeaderName(string(k)) || hasControlChar(v) {
+			return "control_char", string(k)
+		}
+		v = bytes.TrimSpace(v)
+		switch {
+		case bytes.EqualFold(k, []byte("Content-Length")):
+			for _, prior := range contentLength {
+				if !bytes.Equal(prior, v) {
+					return "conflicting_content_length", string(k)
+				}
+			}
+			contentLength = append(contentLength, v)
+		case bytes.EqualFold(k, []byte("Transfer-Encoding")):
+			transferEncoding = append(transferEncoding, v)
+		}
+	}
+	if len(transferEncoding) > 0 {
+		if len(contentLength) > 0 {
+			return "content_length_with_transfer_encoding", "Transfer-Encoding"
+		}
+		if len(transferEncoding) > 1 || !bytes.EqualFold(transferEncoding[0], []byte("chunked")) {
+			return "unsupported_transfer_encoding", "Transfer-Encoding"
+		}
+	}
+	return "", ""
+}
+
+// hasControlChar reports whether a header value contains a control
+// character other than tab, CR and LF included.
+func hasControlChar(v []byte) bool {
+	for _, c := range v {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// phaseTimes accumulates where a request's time went across attempts, for
+// the Server-Timing header.
+type phaseTimes struct {
+	wait     time.Duration // queued for the upstream rate limiter
+	upstream time.Duration // in client.Do, including connecting
+	retry    time.Duration // sleeping between attempts
+}
+
+func phases(ctx *fasthttp.RequestCtx) *phaseTimes {
+	if t, ok := ctx.UserValue("phases").(*phaseTimes); ok {
+		return t
+	}
+	t := &phaseTimes{}
+	ctx.SetUserValue("phases", t)
+	return t
+}
+
+// clientPollInterval is how often a retry wait checks whether the client
+// is still there, as nothing signals a disconnect.
+const clientPollInterval = 100 * time.Millisecond
+
+// retrySleep waits d before the next attempt, counting it as retry time. The
+// wait is cut short once shutdown begins or the client disconnects, and the
+// response to give up with is returned instead: a 503 or a 499. It returns
+// nil after a full wait.
+func retrySleep(ctx *fasthttp.RequestCtx, d time.Duration) *fasthttp.Response {
+	start := time.Now()
+	defer func() { phases(ctx).retry += time.Since(start) }()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	poll := time.NewTicker(clientPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-shutdownStarted:
+			rlog(ctx, map[string]any{"at": "retry_interrupted", "level": "info", "reason": "shutdown", "slept_ms": time.Since(start).Milliseconds(), "sleep_ms": d.Milliseconds()})
+			r := errorResponse(503, "shutting_down", "proxy is shutting down")
+			r.SetConnectionClose()
+			return r
+		case <-poll.C:
+			if clientGone(ctx) {
+				rlog(ctx, map[string]any{"at": "retry_interrupted", "level": "debug", "reason": "client_gone", "slept_ms": time.Since(start).Milliseconds(), "sleep_ms": d.Milliseconds()})
+				return errorResponse(499, "client_closed", "client closed request")
+			}
+		}
+	}
+}
+
+// serverTiming formats the request's phases, whatever time wasn't spent in
+// them as proxy, and the total so far, in Server-Timing syntax.
+func serverTiming(ctx *fasthttp.RequestCtx, total time.Duration) string {
+	t, ok := ctx.UserValue("phases").(*phaseTimes)
+	if !ok {
+		return fmt.Sprintf("proxy;dur=%s, total;dur=%s", ms(total), ms(total))
+	}
+	proxy := max(total-t.wait-t.upstream-t.retry, 0)
+	return fmt.Sprintf("wait;dur=%s, upstream;dur=%s, retry;dur=%s, proxy;dur=%s, total;dur=%s",
+		ms(t.wait), ms(t.upstream), ms(t.retry), ms(proxy), ms(total))
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000)
+}
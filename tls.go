@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var tlsCertFile = getEnv("TLS_CERT_FILE")
+var tlsKeyFile = getEnv("TLS_KEY_FILE")
+
+var clientCAFile = getEnv("CLIENT_CA_FILE")
+var requireClientCert = getEnvBool("REQUIRE_CLIENT_CERT")
+var mtlsOrKey = getEnvBool("MTLS_OR_KEY")
+
+var tlsCert atomic.Pointer[tls.Certificate]
+var clientCAs = loadClientCAs()
+
+func init() {
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		configError("TLS_CERT_FILE", errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if clientCAFile != "" && !tlsEnabled() {
+		configError("CLIENT_CA_FILE", errors.New("client certificates need TLS_CERT_FILE and TLS_KEY_FILE"))
+	}
+	if (requireClientCert || mtlsOrKey) && clientCAFile == "" {
+		configError("REQUIRE_CLIENT_CERT", errors.New("REQUIRE_CLIENT_CERT and MTLS_OR_KEY need CLIENT_CA_FILE"))
+	}
+}
+
+func loadClientCAs() *x509.CertPool {
+	if clientCAFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		configError("CLIENT_CA_FILE", err)
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		configError("CLIENT_CA_FILE", errors.New("no PEM certificates found"))
+	}
+	return pool
+}
+
+// serverTLSConfig is the listener's TLS configuration. With CLIENT_CA_FILE,
+// client certificates are verified against it, and with
+// REQUIRE_CLIENT_CERT a connection without one fails the handshake.
+func serverTLSConfig() *tls.Config {
+	cfg := &tls.Config{GetCertificate: getCertificate}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg
+}
+
+// clientCertCN returns the common name of the client's verified
+// certificate, if it presented one.
+func clientCertCN(ctx *fasthttp.RequestCtx) (string, bool) {
+	state := ctx.TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	return state.PeerCertificates[0].Subject.CommonName, true
+}
+
+func tlsEnabled() bool {
+	return tlsCertFile != "" && tlsKeyFile != ""
+}
+
+func loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return err
+	}
+	tlsCert.Store(&cert)
+	return nil
+}
+
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return tlsCert.Load(), nil
+}
+
+// reloadCertificate swaps in the certificate from disk, keeping the
+// current one if the new pair fails to load.
+func reloadCertificate() {
+	if err := loadCertificate(); err != nil {
+		jlog(map[string]any{"at": "cert_reload_failed", "level": "error", "err": err.Error()})
+		return
+	}
+	jlog(map[string]any{"at": "cert_reloaded", "cert_file": tlsCertFile})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/valyala/fasthttp"
+)
+
+var generateTrace = getEnvBool("GENERATE_TRACE")
+
+// assignRequestID reuses the client's X-Request-ID or generates one, and
+// echoes it back so a client error can be matched to its log lines.
+func assignRequestID(ctx *fasthttp.RequestCtx) {
+	id := string(ctx.Request.Header.Peek("X-Request-ID"))
+	if id == "" {
+		id = randomHex(8)
+	}
+	ctx.SetUserValue("request_id", id)
+	ctx.Response.Header.Set("X-Request-ID", id)
+}
+
+// startTrace picks up the W3C trace ID from the incoming traceparent, or
+// with GENERATE_TRACE starts a new trace when there is none. The traceparent
+// and tracestate headers are forwarded upstream unchanged, unless spans are
+// exported, in which case each attempt sends its own span as the parent.
+func startTrace(ctx *fasthttp.RequestCtx) {
+	id := traceIDFrom(string(ctx.Request.Header.Peek("traceparent")))
+	if id == "" {
+		if !generateTrace {
+			return
+		}
+		id = randomHex(16)
+		if otelEnabled() {
+			// The request span becomes the root instead of a made-up parent.
+			ctx.SetUserValue("trace_id", id)
+			ctx.Response.Header.Set("X-Trace-ID", id)
+			return
+		}
+		ctx.Request.Header.Set("traceparent", "00-"+id+"-"+randomHex(8)+"-01")
+	}
+	ctx.SetUserValue("trace_id", id)
+	ctx.Response.Header.Set("X-Trace-ID", id)
+}
+
+// traceIDFrom extracts the trace ID from a traceparent of the form
+// version-traceid-parentid-flags, or returns "" if it is malformed.
+func traceIDFrom(traceparent string) string {
+	if len(traceparent) < 55 || traceparent[2] != '-' || traceparent[35] != '-' {
+		return ""
+	}
+	id := traceparent[3:35]
+	if _, err := hex.DecodeString(id); err != nil || id == "00000000000000000000000000000000" {
+		return ""
+	}
+	return id
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
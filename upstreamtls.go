@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+var caBundleFile = getEnv("CA_BUNDLE_FILE")
+var tlsInsecureSkipVerify = getEnvBool("TLS_INSECURE_SKIP_VERIFY")
+
+var upstreamTLSConfig = loadUpstreamTLSConfig()
+
+// loadUpstreamTLSConfig returns the client TLS settings for upstream
+// connections, or nil for Go's defaults. CA_BUNDLE_FILE adds roots on top
+// of the system pool rather than replacing it.
+func loadUpstreamTLSConfig() *tls.Config {
+	if caBundleFile == "" && !tlsInsecureSkipVerify {
+		return nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: tlsInsecureSkipVerify}
+	if caBundleFile == "" {
+		return cfg
+	}
+	pem, err := os.ReadFile(caBundleFile)
+	if err != nil {
+		configError("CA_BUNDLE_FILE", err)
+		return cfg
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		configError("CA_BUNDLE_FILE", errors.New("no PEM certificates found"))
+	}
+	cfg.RootCAs = pool
+	return cfg
+}
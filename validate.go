@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// validateOnly, set by VALIDATE_ONLY=true or --validate, checks the
+// configuration and exits without serving.
+var validateOnly = getEnvBool("VALIDATE_ONLY") || slices.Contains(os.Args[1:], "--validate")
+
+// validateAndExit prints the outcome of parsing the configuration, which
+// happened as the package initialised exactly as for a real start, as one
+// JSON object on stdout, and exits 0 if it's valid and 1 if not.
+func validateAndExit() {
+	if tlsEnabled() {
+		if err := loadCertificate(); err != nil {
+			configError("TLS_CERT_FILE", err)
+		}
+	}
+	errs := make([]string, len(configErrors))
+	for i, err := range configErrors {
+		errs[i] = err.Error()
+	}
+	out := map[string]any{
+		"valid":    len(errs) == 0,
+		"errors":   errs,
+		"warnings": append([]string{}, configWarnings...),
+	}
+	if len(errs) == 0 {
+		summary := startupSummary()
+		delete(summary, "at")
+		delete(summary, "level")
+		out["summary"] = summary
+	}
+	b, _ := json.MarshalIndent(out, "", "  ")
+	fmt.Println(string(b))
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}